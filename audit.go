@@ -0,0 +1,92 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Events of the audit records written to AuditWriter.
+const (
+	// AuditLogin records a login attempt of LoginHandler.
+	AuditLogin = "login"
+
+	// AuditRefresh records a refresh attempt of RefreshHandler or RefreshTokenHandler.
+	AuditRefresh = "refresh"
+
+	// AuditDenied records a request rejected by the middleware.
+	AuditDenied = "denied"
+)
+
+// AuditRecord is the json line written to AuditWriter for every auth decision.
+type AuditRecord struct {
+	// Time of the decision, in RFC 3339 format with nanoseconds.
+	Time string `json:"time"`
+
+	// One of AuditLogin, AuditRefresh or AuditDenied.
+	Event string `json:"event"`
+
+	// User the decision is about, when known.
+	UserId string `json:"user_id,omitempty"`
+
+	// IP address of the client.
+	IP string `json:"ip"`
+
+	// Either "success" or "failure".
+	Outcome string `json:"outcome"`
+
+	// Reason of a failure, e.g. "Token is expired".
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditor serializes the records written to AuditWriter, so that concurrent requests don't
+// interleave their lines.
+type auditor struct {
+	writer io.Writer
+	logger Logger
+
+	mutex sync.Mutex
+}
+
+func newAuditor(writer io.Writer, logger Logger) *auditor {
+	return &auditor{writer: writer, logger: logger}
+}
+
+func (a *auditor) write(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		a.logger.Printf("jwt: can't encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.writer.Write(line); err != nil {
+		a.logger.Printf("jwt: can't write audit record: %v", err)
+	}
+}
+
+// audit records the outcome of event for userId, a failure when reason isn't nil.
+func (mw *JWTMiddleware) audit(event string, userId string, request *rest.Request, reason error) {
+	if mw.auditor == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:    mw.TimeFunc().UTC().Format(time.RFC3339Nano),
+		Event:   event,
+		UserId:  userId,
+		IP:      clientIP(request),
+		Outcome: "success",
+	}
+	if reason != nil {
+		record.Outcome = "failure"
+		record.Reason = reason.Error()
+	}
+	mw.auditor.write(record)
+}
@@ -0,0 +1,113 @@
+package jwt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthJWTAuditWriter(t *testing.T) {
+	now := time.Date(2016, 5, 4, 12, 30, 0, 0, time.UTC)
+	audit := &bytes.Buffer{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         []byte("secret key secret key secret key"),
+		MaxRefresh:  time.Hour,
+		AuditWriter: audit,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	run := func(req *http.Request) *test.Recorded {
+		req.RemoteAddr = "192.0.2.1:1234"
+		return test.RunRequest(t, handler, req)
+	}
+
+	run(test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "wrong"})).CodeIs(401)
+
+	recorded := run(test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	token := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &token)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	run(req).CodeIs(200)
+
+	// successful requests aren't audited
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	run(req).CodeIs(200)
+
+	run(test.MakeSimpleRequest("GET", "http://localhost/", nil)).CodeIs(401)
+
+	expected := []map[string]interface{}{
+		{"time": "2016-05-04T12:30:00Z", "event": "login", "user_id": "admin", "ip": "192.0.2.1", "outcome": "failure", "reason": "Incorrect username or password"},
+		{"time": "2016-05-04T12:30:00Z", "event": "login", "user_id": "admin", "ip": "192.0.2.1", "outcome": "success"},
+		{"time": "2016-05-04T12:30:00Z", "event": "refresh", "user_id": "admin", "ip": "192.0.2.1", "outcome": "success"},
+		{"time": "2016-05-04T12:30:00Z", "event": "denied", "ip": "192.0.2.1", "outcome": "failure", "reason": "Auth header empty"},
+	}
+
+	records := []map[string]interface{}{}
+	scanner := bufio.NewScanner(audit)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected json lines, got %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("unexpected audit records\n got: %v\nwant: %v", records, expected)
+	}
+}
+
+func TestAuthJWTAuditWriterDisabled(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	authMiddleware.MiddlewareFunc(nil)
+
+	recorded := test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(401)
+
+	if authMiddleware.auditor != nil {
+		t.Error("expected no auditor without AuditWriter")
+	}
+}
@@ -4,68 +4,951 @@ import (
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/dgrijalva/jwt-go"
 
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Errors passed to the Unauthorized callback, allowing callers to tell the failure reasons apart.
+var (
+	// ErrNoAuthHeader is returned when the auth header is missing or empty.
+	ErrNoAuthHeader = errors.New("Auth header empty")
+
+	// ErrInvalidAuthHeader is returned when the auth header doesn't have the expected format.
+	ErrInvalidAuthHeader = errors.New("Invalid auth header")
+
+	// ErrNoAuthCookie is returned when the auth cookie is missing or empty.
+	ErrNoAuthCookie = errors.New("Auth cookie empty")
+
+	// ErrNoAuthQueryParam is returned when the auth query parameter is missing or empty.
+	ErrNoAuthQueryParam = errors.New("Auth query parameter empty")
+
+	// ErrNoAuthProtocol is returned when the Sec-WebSocket-Protocol header doesn't carry a token
+	// after the prefix of a "protocol" TokenLookup.
+	ErrNoAuthProtocol = errors.New("Auth subprotocol empty")
+
+	// ErrInvalidTokenLookup is returned when TokenLookup names an unknown source.
+	ErrInvalidTokenLookup = errors.New("Invalid token lookup")
+
+	// ErrTokenTooLong is returned when the token exceeds MaxTokenLength.
+	ErrTokenTooLong = errors.New("Token is too long")
+
+	// ErrInvalidSigningAlgorithm is returned when the token isn't signed with one of
+	// VerificationAlgorithms.
+	ErrInvalidSigningAlgorithm = errors.New("Invalid signing algorithm")
+
+	// ErrUnknownKID is returned when Keys is set and has no key for the kid header of the token.
+	ErrUnknownKID = errors.New("Unknown key id")
+
+	// ErrKeyUnavailable is returned when KeyFunc fails to provide the verification key.
+	ErrKeyUnavailable = errors.New("Key unavailable")
+
+	// ErrExpiredToken is returned when the token is correctly signed but has expired.
+	ErrExpiredToken = errors.New("Token is expired")
+
+	// ErrTokenNotValidYet is returned when the token is correctly signed but its nbf claim, or its
+	// iat claim with VerifyIssuedAt, lies in the future.
+	ErrTokenNotValidYet = errors.New("Token is not valid yet")
+
+	// ErrInvalidToken is returned when the token is malformed or its signature is invalid.
+	ErrInvalidToken = errors.New("Token is invalid")
+
+	// ErrInvalidIssuer is returned when Issuer is set and the iss claim doesn't match it.
+	ErrInvalidIssuer = errors.New("Invalid issuer")
+
+	// ErrInvalidAudience is returned when Audience is set and the aud claim doesn't contain it.
+	ErrInvalidAudience = errors.New("Invalid audience")
+
+	// ErrRevokedToken is returned when the jti of the token was revoked in the RevocationStore or
+	// is unknown to the TokenStore, when its session started before NotBefore or MinIssuedAt, or
+	// when its ver claim isn't the current version of the TokenVersionStore.
+	ErrRevokedToken = errors.New("Token is revoked")
+
+	// ErrInvalidTokenType is returned when a refresh token is used as access token or vice versa.
+	ErrInvalidTokenType = errors.New("Invalid token type")
+
+	// ErrRefreshTokenReused is returned when an already consumed refresh token is presented.
+	ErrRefreshTokenReused = errors.New("Refresh token was already used")
+
+	// ErrTokenAlreadyUsed is returned when a one-time token is presented again, see
+	// GenerateOneTimeToken.
+	ErrTokenAlreadyUsed = errors.New("Token was already used")
+
+	// ErrMissingClaim is returned when the token lacks one of RequiredClaims.
+	ErrMissingClaim = errors.New("Missing required claim")
+
+	// ErrFingerprintMismatch is returned when the token is presented by another client than the
+	// one it was issued to, see FingerprintFunc.
+	ErrFingerprintMismatch = errors.New("Token fingerprint mismatch")
+
+	// ErrInvalidIdentity is returned when the identity claim is missing or not a string.
+	ErrInvalidIdentity = errors.New("Invalid identity claim")
+
+	// ErrForbidden is returned when the Authorizator rejects the user. The request is rejected
+	// with a 401, AuthorizatorWithError can return an *HTTPError for a 403.
+	ErrForbidden = errors.New("Forbidden")
+
+	// ErrInvalidLoginPayload is returned when the login payload can't be decoded. The request is
+	// rejected with a 400.
+	ErrInvalidLoginPayload = errors.New("Invalid login payload")
+
+	// ErrTooManyLoginAttempts is returned when the LoginRateLimiter denies a login attempt. The
+	// request is rejected with a 429.
+	ErrTooManyLoginAttempts = errors.New("Too many login attempts")
+
+	// ErrRefreshTooSoon is returned by RefreshHandler and RefreshTokenHandler when the presented
+	// token was issued less than MinRefreshInterval ago. The request is rejected with a 429 and a
+	// Retry-After header.
+	ErrRefreshTooSoon = errors.New("Token refreshed too soon")
+
+	// ErrLoginDisabled is returned by LoginHandler while LoginEnabled returns false.
+	ErrLoginDisabled = errors.New("Login is temporarily disabled")
+
+	// ErrAuthenticatorUnavailable is returned by LoginHandler when the AuthenticatorWithContext
+	// fails, or gives up because the login request was canceled or timed out, rather than
+	// rejecting the credentials. The request is answered with a 503.
+	ErrAuthenticatorUnavailable = errors.New("Authenticator unavailable")
+
+	// ErrFailedAuthentication is returned when the Authenticator rejects the credentials.
+	ErrFailedAuthentication = errors.New("Incorrect username or password")
+
+	// ErrInvalidOrigIat is returned when the orig_iat claim is missing or not a number.
+	ErrInvalidOrigIat = errors.New("Invalid orig_iat claim")
+
+	// ErrInactiveSession is returned when the session of the token was revoked in the SessionStore
+	// or has expired.
+	ErrInactiveSession = errors.New("Session is not active")
+
+	// ErrExpiredRefresh is returned when the token is older than MaxRefresh.
+	ErrExpiredRefresh = errors.New("Token can no longer be refreshed")
+
+	// ErrFailedTokenCreation is returned when the token can't be signed.
+	ErrFailedTokenCreation = errors.New("Failed to create token")
+)
+
+// Minimum length of the keys of the HS algorithms, their hash size, below which they can be
+// brute-forced.
+var minHMACKeyLengths = map[string]int{
+	"HS256": 32,
+	"HS384": 48,
+	"HS512": 64,
+}
+
+// Logger receives the diagnostics of the middleware, e.g. a *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger is the default Logger, writing to the standard logger of the log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// HTTPError is an error that carries the status code and message of the response rejecting the
+// request, e.g. returned by AuthorizatorWithError to deny access with a 403.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Message
+}
+
+// CookieOptions holds the attributes of the cookie carrying the token when TokenLookup reads it
+// from a cookie.
+type CookieOptions struct {
+	// Optional, defaults to "/".
+	Path string
+
+	// Optional, defaults to the host of the request.
+	Domain string
+
+	// Lifetime of the cookie in seconds. Optional, defaults to the lifetime of the token.
+	MaxAge int
+
+	// Only send the cookie over https. Optional, defaults to true unless AllowInsecure is set.
+	Secure bool
+
+	// Send the cookie over plain http too, e.g. for local development. Optional, defaults to false.
+	AllowInsecure bool
+
+	// Hide the cookie from javascript. Optional, defaults to true unless AllowScriptAccess is set.
+	HttpOnly bool
+
+	// Let javascript read the cookie. Optional, defaults to false.
+	AllowScriptAccess bool
+
+	// Optional, defaults to http.SameSiteLaxMode. Cross-site requests, e.g. from an iframe on
+	// another origin, only send the cookie with http.SameSiteNoneMode, which requires Secure.
+	SameSite http.SameSite
+}
+
 // JWTMiddleware provides a Json-Web-Token authentication implementation. On failure, a 401 HTTP response
 // is returned. On success, the wrapped middleware is called, and the userId is made available as
-// request.Env["REMOTE_USER"].(string).
+// request.Env["REMOTE_USER"].(string). The decoded claims of the token are made available as
+// request.Env["JWT_PAYLOAD"].(map[string]interface{}). When the token has an expiry, the time left
+// before it expires is made available as request.Env["JWT_EXPIRES_IN"].(time.Duration).
+// The userId and the claims are also carried by the context of the request, see
+// IdentityFromContext and ClaimsFromContext.
 // Users can get a token by posting a json request to LoginHandler. The token then needs to be passed in
 // the Authentication header. Example: Authorization:Bearer XXX_TOKEN_XXX
+// Alternatively the token can be read from a cookie, see TokenLookup.
 type JWTMiddleware struct {
-	// Realm name to display to the user. Required.
+	// Realm name to display to the user. Required, unless RealmFunc is set.
 	Realm string
 
-	// signing algorithm - possible values are HS256, HS384, HS512
-	// Optional, default is HS256.
+	// Callback function resolving the realm of each request, used in the WWW-Authenticate header,
+	// e.g. from its Host when one middleware serves several APIs. Falls back to Realm when it
+	// returns an empty string. Optional.
+	RealmFunc func(request *rest.Request) string
+
+	// signing algorithm - possible values are HS256, HS384, HS512, RS256, RS384, RS512, ES256,
+	// ES384 or ES512
+	// Optional, inferred from the configured keys when empty: RS256 for PrivKey, ES256, ES384 or
+	// ES512 depending on the curve of ECPrivKey, HS256 for Key, KeyString, Keys or KeyForTenant,
+	// then RS256 or ES* for a sole PubKey or ECPubKey, and HS256 otherwise. When set, it must
+	// match the type of PrivKey and ECPrivKey.
 	SigningAlgorithm string
 
-	// Secret key used for signing. Required.
+	// Algorithms accepted when verifying tokens, e.g. []string{"RS256", "HS256"} to keep accepting
+	// the HS256 tokens issued before a migration to RS256. New tokens are always signed with
+	// SigningAlgorithm, which must be part of them. The keys of all the listed algorithms are
+	// required, so that e.g. a SigningAlgorithm of HS256 with a PubKey also accepts the RS256
+	// tokens of an identity provider, without being able to issue them.
+	// Optional, defaults to SigningAlgorithm only.
+	VerificationAlgorithms []string
+
+	// Secret key used for signing. Required for HS algorithms, unless Keys is set.
 	Key []byte
 
+	// Secret key used for signing, as a string. Optional, converted to Key when set. Can't be
+	// combined with Key.
+	KeyString string
+
+	// Secret keys for HS algorithms, indexed by key id, to rotate keys without invalidating the
+	// tokens signed with the previous ones. New tokens are signed with the key of ActiveKID, which
+	// is stamped in their kid header, and incoming tokens are verified with the key matching
+	// their kid header. Optional, Key is used when empty.
+	Keys map[string][]byte
+
+	// Id of the key in Keys used to sign new tokens. Required if Keys is set.
+	ActiveKID string
+
+	// Accept HS keys shorter than the hash size of their algorithm, 32 bytes for HS256, 48 for
+	// HS384 and 64 for HS512, which can be brute-forced. Only meant for tests.
+	// Optional, defaults to false.
+	AllowWeakKey bool
+
+	// Private key used for signing with RS algorithms. Only needed by services issuing tokens
+	// through LoginHandler or RefreshHandler.
+	PrivKey *rsa.PrivateKey
+
+	// Public key used for verifying tokens signed with RS algorithms. Optional if PrivKey is set,
+	// defaults to its public part.
+	PubKey *rsa.PublicKey
+
+	// Private key used for signing with ES algorithms. Only needed by services issuing tokens
+	// through LoginHandler or RefreshHandler.
+	ECPrivKey *ecdsa.PrivateKey
+
+	// Public key used for verifying tokens signed with ES algorithms. Optional if ECPrivKey is set,
+	// defaults to its public part.
+	ECPubKey *ecdsa.PublicKey
+
+	// TokenLookup is a string in the form of "<source>:<name>" that is used to extract the token
+	// from the request. Possible sources are "header", "cookie", "query" and "protocol", e.g.
+	// "header:Authorization", "cookie:jwt" or "query:access_token". Tokens read from a cookie may
+	// omit the "Bearer " prefix. Avoid the "query" source when possible, tokens in the query
+	// string leak into access logs, Referer headers and browser history. The "protocol" source
+	// authenticates WebSocket handshakes, whose headers browsers can't set: with
+	// "protocol:access_token" the token is the subprotocol following "access_token" in the
+	// Sec-WebSocket-Protocol header, e.g. "access_token, TOKEN", and "access_token" is echoed back
+	// as the selected subprotocol. Several locations can be separated by commas, e.g.
+	// "header:Authorization,cookie:jwt", they are tried in order and the first one holding a token
+	// is used.
+	// Optional, defaults to "header:Authorization".
+	TokenLookup string
+
+	// Attributes of the cookie set by LoginHandler, RefreshHandler and RefreshTokenHandler when
+	// TokenLookup reads the token from a cookie. The unset attributes get their defaults, in a
+	// copy that leaves the given options unchanged. Optional, defaults to a Secure and HttpOnly
+	// cookie with SameSite=Lax.
+	CookieOptions *CookieOptions
+
+	// Name of a response header, e.g. "X-Auth-Token", in which LoginHandler, RefreshHandler and
+	// RefreshTokenHandler also return the issued token, so that clients and proxies can pick it up
+	// without parsing the body. Optional, disabled by default.
+	TokenResponseHeader string
+
+	// Name of a query string parameter, e.g. "access_token", that is consulted when no token was
+	// found in the location configured by TokenLookup.
+	//
+	// Deprecated: append "query:<name>" to TokenLookup instead, which this field does on setup.
+	TokenQueryParam string
+
+	// Authentication scheme that is expected in front of the token when it is read from a header,
+	// compared case-insensitively. Optional, defaults to "Bearer".
+	TokenHeadName string
+
+	// Accept the raw token in the header without any authentication scheme in front of it.
+	// Takes precedence over TokenHeadName. Optional, defaults to false.
+	NoTokenHeadName bool
+
+	// Maximum length in bytes of the tokens handed to the parser, longer ones are rejected
+	// without being decoded. Optional, defaults to 4096.
+	MaxTokenLength int
+
+	// Name of the claim holding the identity of the user. Optional, defaults to "id".
+	IdentityKey string
+
+	// Name of the claim holding the time of the login, which is kept across refreshes and bounds
+	// them, see MaxRefresh. Allows refreshing tokens issued by other systems.
+	// Optional, defaults to "orig_iat".
+	OrigIatKey string
+
+	// Also store the identity of the user in the standard sub claim of issued tokens, for OIDC
+	// aware consumers, whatever the IdentityKey. Optional, defaults to false.
+	SetSubject bool
+
+	// Path of a PEM encoded private key file that is read into PrivKey or ECPrivKey, depending on
+	// SigningAlgorithm, on initialization. Without SigningAlgorithm, the type of the key selects
+	// it as for PrivKey and ECPrivKey. Optional.
+	PrivKeyFile string
+
+	// Path of a PEM encoded public key file that is read into PubKey or ECPubKey, depending on
+	// SigningAlgorithm, on initialization. Optional.
+	PubKeyFile string
+
+	// URL of a JWKS (JSON Web Key Set) document, as published by identity providers, used to verify
+	// tokens signed with RS or ES algorithms by a third party. The key is selected by the kid
+	// header of the token. When the kid is unknown, the document is fetched again once before the
+	// token is rejected. PubKey and ECPubKey are not needed in this mode. Optional.
+	JWKSURL string
+
+	// Duration the keys fetched from JWKSURL are cached. Optional, defaults to one hour.
+	JWKSRefreshInterval time.Duration
+
+	// URL of an OAuth 2.0 token introspection endpoint (RFC 7662), to which the opaque tokens,
+	// that aren't JWTs, are POSTed. Tokens reported active are accepted with the claims of the
+	// response as payload, and their sub claim as identity unless IdentityKey is among them.
+	// These claims are checked against Issuer, Audience, RevocationStore, NotBefore, MinIssuedAt
+	// and TokenVersionStore like the ones of JWTs. Positive results are cached until the exp claim
+	// of the response. Optional, by default only JWTs are accepted.
+	IntrospectionURL string
+
+	// Credentials authenticating the middleware to IntrospectionURL with HTTP basic auth.
+	// Optional, by default the requests aren't authenticated.
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+
+	// Function returning the key verifying the token, e.g. fetched from a vault, in place of the
+	// keys above. It must cache the keys itself, as it's called for every token. Failures reject
+	// the token with ErrKeyUnavailable. Tokens whose alg isn't one of VerificationAlgorithms are
+	// rejected before it's called. Optional.
+	KeyFunc func(token *jwt.Token) (interface{}, error)
+
+	// Function returning the key signing new tokens, in place of the keys above, e.g. fetched from
+	// a vault. Failures fail the login or the refresh. Optional.
+	SigningKeyFunc func() (interface{}, error)
+
+	// Function returning the HS key of a tenant, so that every tenant has its own secret. New
+	// tokens are signed with the key of their TenantClaim, set by the PayloadFunc, which is also
+	// stored in their kid header to select the key verifying them. Tokens whose tenant claim
+	// doesn't match their kid are rejected. Keys shorter than the hash size of the algorithm
+	// fail the signing or the verification, see AllowWeakKey. Replaces Key and Keys, requires an
+	// HS SigningAlgorithm. Optional.
+	KeyForTenant func(tenant string) ([]byte, error)
+
+	// Name of the claim holding the tenant of the user, see KeyForTenant.
+	// Optional, defaults to "tenant".
+	TenantClaim string
+
+	// Key encrypting the issued tokens into a JWE (RFC 7516), in addition to signing them, so that
+	// clients can't read their claims. Tokens are directly encrypted with the key ("dir"), which
+	// must therefore be shared by all the servers issuing and verifying tokens and kept secret
+	// from everyone else, like an HS Key. It should be distinct from the signing key. Changing it
+	// invalidates all the issued tokens, and tokens that aren't encrypted with it are rejected.
+	// Optional, tokens are only signed by default.
+	EncryptionKey []byte
+
+	// Content encryption algorithm of the JWE, A128GCM, A192GCM or A256GCM, taking a key of 16,
+	// 24 or 32 bytes respectively. Optional, defaults to A256GCM.
+	EncryptionAlgorithm string
+
 	// Duration that a jwt token is valid. Optional, defaults to one hour.
 	Timeout time.Duration
 
+	// Value of the iss claim stamped on issued tokens. When set, tokens with another issuer are
+	// rejected. Optional, by default the claim is neither set nor checked.
+	Issuer string
+
+	// Value of the aud claim stamped on issued tokens. When set, tokens whose audience, either a
+	// single string or an array of strings, doesn't contain it are rejected.
+	// Optional, by default the claim is neither set nor checked.
+	Audience string
+
+	// Function generating the unique jti claim of every issued token. Optional, defaults to a random UUID.
+	JTIFunc func() string
+
+	// Store consulted to reject tokens that were revoked before they expired, looked up by their
+	// jti claim. Tokens issued by this middleware always carry a jti. Tokens without one can't be
+	// revoked and are accepted. Optional, by default tokens are never revoked.
+	RevocationStore RevocationStore
+
+	// Store recording every access token issued by the middleware, see MemoryTokenStore. Only the
+	// tokens it knows are accepted, and LogoutHandler deletes the presented token, revoking it.
+	// Refreshable tokens are kept until the end of their refresh window, so that RefreshHandler
+	// can still refresh them once expired, and are deleted once refreshed. Each login also
+	// records its session, under "sid:" followed by the sid claim of its tokens, which are
+	// rejected once the session is deleted. Optional, by default tokens are stateless.
+	TokenStore TokenStore
+
+	// Maximum number of sessions of a user in the TokenStore, which must be a UserTokenStore.
+	// When a login exceeds it, LoginHandler deletes the oldest sessions, revoking their access
+	// and refresh tokens. Refreshing a token doesn't start a new session.
+	// Optional, by default the number of sessions is unlimited.
+	MaxSessionsPerUser int
+
+	// Store consuming the one-time tokens created by GenerateOneTimeToken, e.g. a
+	// MemoryRevocationStore, so that the middleware, IdentityIfPresent, ValidateHandler and
+	// BindClaims accept each of them only once. Optional, one-time tokens are rejected without it.
+	OneTimeTokenStore RefreshTokenStore
+
+	// Store keeping the token version of every user, see MemoryTokenVersionStore. The issued
+	// tokens carry the current version of their user in the ver claim, and only the tokens of the
+	// current version are accepted, see BumpTokenVersion. Tokens without a ver claim are rejected.
+	// Optional, by default tokens aren't versioned.
+	TokenVersionStore TokenVersionStore
+
+	// Tokens whose session started before this time, according to their OrigIatKey claim or else
+	// their iat claim, are rejected as revoked, e.g. to log every user out after a key compromise.
+	// Optional, defaults to the zero time meaning no cutoff.
+	NotBefore time.Time
+
+	// Callback function returning the time before which the sessions of userId are rejected as
+	// revoked, like NotBefore, e.g. to log a user out of all their devices. Optional, the zero time
+	// means no cutoff.
+	MinIssuedAt func(userId string) time.Time
+
+	// Tolerance applied when validating the exp and nbf claims, and the iat claim with
+	// VerifyIssuedAt, to account for clock skew between the servers issuing and verifying tokens.
+	// Optional, defaults to 0 meaning no tolerance.
+	Leeway time.Duration
+
+	// Reject tokens whose iat claim lies in the future, beyond Leeway.
+	// Optional, by default iat isn't validated.
+	VerifyIssuedAt bool
+
+	// Duration by which the iat claim of issued tokens is backdated, so that strict verifiers whose
+	// clock is slightly behind don't see freshly issued tokens in the future. The refresh window
+	// isn't affected. Optional, defaults to 0.
+	IssuedAtBackdate time.Duration
+
+	// Function that provides the current time, used when issuing and validating tokens.
+	// Optional, defaults to time.Now.
+	TimeFunc func() time.Time
+
 	// This field allows clients to refresh their token until MaxRefresh has passed.
 	// Note that clients can refresh their token in the last moment of MaxRefresh.
 	// This means that the maximum validity timespan for a token is MaxRefresh + Timeout.
 	// Optional, defaults to 0 meaning not refreshable.
 	MaxRefresh time.Duration
 
+	// Extra time after MaxRefresh during which RefreshHandler still accepts a token, so refreshes
+	// sent in the last moment of MaxRefresh don't fail on their way to the server.
+	// Optional, defaults to 0 meaning no grace period.
+	RefreshGracePeriod time.Duration
+
+	// Minimum age of the token presented to RefreshHandler, or of the refresh token presented to
+	// RefreshTokenHandler, going by its iat claim, so that a misbehaving client can't issue tokens
+	// in a tight loop. Younger tokens are rejected with a 429, whose Retry-After header tells when
+	// they can be refreshed. Tokens without iat aren't throttled.
+	// Optional, defaults to 0 meaning no minimum.
+	MinRefreshInterval time.Duration
+
+	// Silently reissue the token of authenticated requests when it expires within SlidingWindow,
+	// as long as it's still refreshable according to MaxRefresh. The new token is returned in the
+	// TokenResponseHeader and, when the token is read from a cookie, in that cookie. Requires
+	// MaxRefresh and one of these two locations. Optional, defaults to false.
+	SlidingExpiration bool
+
+	// Time before the expiry of a token from which SlidingExpiration reissues it.
+	// Optional, defaults to half of Timeout.
+	SlidingWindow time.Duration
+
+	// Duration that the refresh tokens issued by LoginHandler in the refresh_token field of its
+	// default response are valid. Refresh tokens can only be exchanged for a new access token
+	// through RefreshTokenHandler and are rejected by the middleware itself. They are long-lived
+	// bearer credentials: clients should keep them in secure storage and only send them to
+	// RefreshTokenHandler. Being stateless, a leaked refresh token stays usable until it expires
+	// unless its jti is revoked through the RevocationStore.
+	// Optional, defaults to 0 meaning no refresh tokens are issued.
+	RefreshTokenTimeout time.Duration
+
+	// Store used to rotate refresh tokens: each refresh token can only be exchanged once by
+	// RefreshTokenHandler, which then issues a new one. Presenting an already consumed refresh
+	// token is rejected and reported to RefreshReuseDetected, as it hints at a stolen token. Note
+	// that if the same store is used as RevocationStore, reused tokens are rejected as revoked
+	// before they reach this check.
+	// Optional, by default refresh tokens can be used until they expire.
+	RefreshTokenStore RefreshTokenStore
+
+	// Callback function called with the userId when an already consumed refresh token is
+	// presented, e.g. to revoke all the sessions of the user. Optional.
+	RefreshReuseDetected func(userId string)
+
+	// Store recording the sessions started by a login, so that they can be revoked centrally, see
+	// MemorySessionStore. Each login creates a session lasting MaxRefresh and RefreshGracePeriod,
+	// or RefreshTokenTimeout when longer, whose id is stored in the sid claim of its access and
+	// refresh tokens. Tokens whose session isn't active anymore can't be refreshed by
+	// RefreshHandler, RefreshTokenHandler or SlidingExpiration, while access tokens stay valid
+	// until they expire. Requires MaxRefresh. Optional, by default the refresh window is only
+	// enforced by the OrigIatKey claim.
+	SessionStore SessionStore
+
 	// Callback function that should perform the authentication of the user based on userId and
-	// password. Must return true on success, false on failure. Required.
+	// password. Must return true on success, false on failure. Required, unless
+	// AuthenticatorWithRequest, AuthenticatorWithContext or LoginPayloadFunc is set.
 	Authenticator func(userId string, password string) bool
 
+	// Same as Authenticator, but also receives the login request, e.g. to throttle by client IP or
+	// to inspect headers. Existing Authenticator functions can be migrated by simply adding the
+	// request parameter. Takes precedence over Authenticator when both are set.
+	AuthenticatorWithRequest func(userId string, password string, request *rest.Request) bool
+
+	// Same as Authenticator, but receives the context of the login request, so that calls to a
+	// remote identity store can respect the client cancellation and deadlines. An error, or a
+	// failure once the context is done, means the credentials couldn't be checked and is answered
+	// with a 503 and ErrAuthenticatorUnavailable instead of a 401. Takes precedence over
+	// AuthenticatorWithRequest and Authenticator when set.
+	AuthenticatorWithContext func(ctx context.Context, userId string, password string) (bool, error)
+
+	// Callback function that extracts and verifies the credentials of a login request in any
+	// format, e.g. an email and a one-time password. Must return the userId and true on success,
+	// false on failure. When set, LoginHandler doesn't decode the default username/password
+	// payload and doesn't call the Authenticator. Optional.
+	LoginPayloadFunc func(request *rest.Request) (userId string, ok bool)
+
+	// Callback function resolving the identity stored in the token from the userId of a successful
+	// login, e.g. to store the immutable id of a user logging in with an email. Returning false
+	// fails the login. Optional, by default the userId is stored as is.
+	IdentityMapper func(loginUserId string) (identity string, ok bool)
+
+	// Let LoginHandler read the username and password from HTTP Basic credentials in the
+	// Authorization header when the request has no body, e.g. for `curl -u user:pass`. The json
+	// payload takes precedence. Optional, defaults to false.
+	BasicAuthLogin bool
+
+	// Names of the fields of the json login payload holding the credentials.
+	// Optional, default to "username" and "password".
+	UsernameField string
+	PasswordField string
+
+	// Limiter consulted by LoginHandler before verifying the credentials, see
+	// MemoryLoginRateLimiter. Optional, by default login attempts aren't limited.
+	LoginRateLimiter LoginRateLimiter
+
+	// Callback function consulted by LoginHandler before anything else. While it returns false,
+	// e.g. during maintenance, logins are rejected with a 503 and the tokens already issued stay
+	// valid. Optional, by default logins are always enabled.
+	LoginEnabled func() bool
+
 	// Callback function that should perform the authorization of the authenticated user. Called
 	// only after an authentication success. Must return true on success, false on failure.
 	// Optional, default to success.
 	Authorizator func(userId string, request *rest.Request) bool
-	
-	// need prompt return on unauthorized
+
+	// Same as Authorizator, but returns nil on success and an error on failure. Returning an
+	// *HTTPError rejects the request with its status code and message, e.g. a 403 for an
+	// authenticated user lacking permission. Other errors are rejected with a 401.
+	// Optional, takes precedence over Authorizator when set.
+	AuthorizatorWithError func(userId string, request *rest.Request) error
+
+	// Callback function enforcing custom rules on the claims of valid tokens, e.g. requiring a
+	// tenant claim, called before the Authorizator. Must return nil on success and an error on
+	// failure, which rejects the request with a 401, or with the status code and message of an
+	// *HTTPError. Optional.
+	ClaimsValidator func(claims map[string]interface{}, request *rest.Request) error
+
+	// Claims that valid tokens must contain, e.g. []string{"tenant", "role"}, checked before the
+	// ClaimsValidator. Tokens missing one are rejected with a 401. Optional.
+	RequiredClaims []string
+
+	// Function returning the fingerprint of the client, e.g. its User-Agent and the value of a
+	// random cookie set by the client. Its SHA-256 hash is stored in the fgp claim of the tokens
+	// issued by LoginHandler, which are then rejected when presented with another fingerprint,
+	// limiting the use of stolen tokens. Refreshed tokens keep the claim. Tokens without the claim,
+	// e.g. created by GenerateToken, aren't bound to a client. Optional.
+	FingerprintFunc func(request *rest.Request) string
+
+	// Callback function that will be called during login and refresh. Using this function it is
+	// possible to add additional claims to the token. The claims reserved by the middleware
+	// (IdentityKey, sub, exp, OrigIatKey, fgp, sid, one_time, token_type, ver, iat, iss, aud and
+	// jti) are dropped from the returned ones, even when the middleware doesn't set them itself.
+	// Returning a nbf claim issues a token that only becomes valid at the given unix time.
+	// The claims aren't copied from the refreshed token, so that changes of e.g. the roles of the
+	// user are reflected without a new login.
+	// Optional, by default no additional claims will be added.
+	PayloadFunc func(userId string) map[string]interface{}
+
+	// Callback function that writes the response of LoginHandler and RefreshHandler, receiving the
+	// status code, the issued token and its expiry time.
+	// Optional, by default a response of the form {"token": "TOKEN", "expire": "RFC3339 TIME"} is
+	// written.
+	LoginResponseFunc func(writer rest.ResponseWriter, code int, token string, expire time.Time)
+
+	// Claims returned by the PayloadFunc that LoginHandler also includes in a "user" object of its
+	// response, e.g. []string{"name", "roles"}, so that clients don't have to decode the token.
+	// Only the listed claims are included, keeping the other ones private. Ignored when
+	// LoginResponseFunc is set. Optional, by default no user object is returned.
+	LoginResponseClaims []string
+
+	// Callback function that shapes the default response of LoginHandler and RefreshHandler, e.g.
+	// returning map[string]interface{}{"data": response, "error": nil} to wrap it in an envelope.
+	// The returned value is written as json. Ignored when LoginResponseFunc is set.
+	// Optional, by default the response is written as is.
+	ResponseEnvelope func(response map[string]interface{}) interface{}
+
+	// Content-Type of the default response of LoginHandler and RefreshHandler, e.g.
+	// "application/vnd.api+json". Ignored when LoginResponseFunc is set.
+	// Optional, defaults to "application/json; charset=utf-8".
+	ResponseContentType string
+
+	// Let the requests without a valid token through as anonymous, e.g. for pages personalized
+	// for logged in users. Their handler is called without REMOTE_USER, while requests with a
+	// valid token are authenticated as usual and can still be rejected by the Authorizator.
+	// Optional, defaults to false.
+	Optional bool
+
+	// Let OPTIONS requests through to the handler without authentication, as browsers send CORS
+	// preflight requests without credentials. Optional, defaults to false.
+	AllowPreflight bool
+
+	// Callback function letting the requests for which it returns true through to the handler
+	// without authentication, e.g. health checks and public routes sharing the middleware.
+	// Optional, by default every request is authenticated.
+	Skipper func(request *rest.Request) bool
+
+	// Set a WWW-Authenticate header on rejected requests, as described by RFC 6750, e.g.
+	// Bearer realm="Realm", error="invalid_token", error_description="Token is expired".
+	// The header doesn't change the body, which stays json, and is also set before calling the
+	// Unauthorized callback, so that custom error bodies keep the challenge. It's only set on the
+	// rejections answered with a 401 or a 403, and on the unreadable tokens answered with a 400,
+	// see HTTPStatusForError.
+	// Optional, defaults to false.
 	NeedPrompt bool
+
+	// Callback function that writes the response when a request is rejected. It receives the
+	// reason of the rejection, which allows to tell an expired token from a malformed one, see
+	// HTTPStatusForError. Optional, by default the status of HTTPStatusForError is returned with
+	// the reason as error, except for the 401, which is answered with {"Error": "Not Authorized"}
+	// and an additional "Code": "token_expired" when the token has expired.
+	Unauthorized func(writer rest.ResponseWriter, request *rest.Request, reason error)
+
+	// Callback functions notified of the authentication events, e.g. to feed an audit log. They
+	// receive the userId, which is the submitted username for failed logins and may be empty when
+	// the login payload couldn't be decoded. Optional.
+	OnLoginSuccess        func(userId string, request *rest.Request)
+	OnLoginFailure        func(userId string, request *rest.Request)
+	OnAuthorizationDenied func(userId string, request *rest.Request)
+	OnTokenRefresh        func(userId string, request *rest.Request)
+
+	// Callback function called once the request is authorized, right before the handler, with
+	// REMOTE_USER and JWT_PAYLOAD already set. It can populate request.Env, e.g. with the
+	// permissions of the user, so that the handler doesn't have to load them again. Optional.
+	OnAuthorized func(userId string, request *rest.Request)
+
+	// Logger receiving the diagnostics of the middleware, such as failures to write a response, to
+	// sign a token or to fetch the JWKS document.
+	// Optional, defaults to the standard logger of the log package.
+	Logger Logger
+
+	// Receiver of the counters and timings of the middleware, see Metrics.
+	// Optional, by default nothing is recorded.
+	Metrics Metrics
+
+	// Writer receiving an audit trail of the auth decisions, one json AuditRecord per line for
+	// every login, refresh and denied request, e.g. an append-only file. Writes are serialized.
+	// Optional, by default nothing is audited.
+	AuditWriter io.Writer
+
+	signingMethod jwt.SigningMethod
+	jwks          *jwksCache
+	introspector  *introspector
+	auditor       *auditor
+	initialized   bool
 }
 
 // MiddlewareFunc makes JWTMiddleware implement the Middleware interface.
+// The configuration is validated on the first call, exiting the process when invalid, unless the
+// middleware was created by New.
 func (mw *JWTMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	if !mw.initialized {
+		if err := mw.setup(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	return func(writer rest.ResponseWriter, request *rest.Request) { mw.middlewareImpl(writer, request, handler) }
+}
+
+// New validates the configuration of the middleware and sets the defaults of its optional fields,
+// returning an error describing the first invalid field instead of exiting the process like
+// MiddlewareFunc.
+func New(mw JWTMiddleware) (*JWTMiddleware, error) {
+	if err := mw.setup(); err != nil {
+		return nil, err
+	}
+	return &mw, nil
+}
 
-	if mw.Realm == "" {
-		log.Fatal("Realm is required")
+// LoadFromEnv sets Realm and Key from the environment variables <prefix>REALM and <prefix>KEY,
+// e.g. JWT_REALM and JWT_KEY for the prefix "JWT_", keeping secrets out of the code. Fields that
+// are already set are left alone, and the key is only loaded for the HS algorithms when no other
+// key source is configured. Returns an error when a required variable is missing or empty.
+// Must be called before MiddlewareFunc or New.
+func (mw *JWTMiddleware) LoadFromEnv(prefix string) error {
+	if mw.Realm == "" && mw.RealmFunc == nil {
+		mw.Realm = os.Getenv(prefix + "REALM")
+		if mw.Realm == "" {
+			return errors.New(prefix + "REALM is not set")
+		}
+	}
+
+	algorithm := mw.SigningAlgorithm
+	if algorithm == "" && mw.PrivKeyFile == "" && mw.PubKeyFile == "" {
+		// the algorithm of key files is only known once setup has read them
+		algorithm = mw.inferSigningAlgorithm()
+	}
+	needsKey := strings.HasPrefix(algorithm, "HS")
+	if needsKey && mw.Key == nil && mw.KeyString == "" && mw.Keys == nil && mw.KeyFunc == nil {
+		key := os.Getenv(prefix + "KEY")
+		if key == "" {
+			return errors.New(prefix + "KEY is not set")
+		}
+		mw.Key = []byte(key)
+	}
+
+	return nil
+}
+
+// setup validates the configuration and sets the defaults of the optional fields.
+func (mw *JWTMiddleware) setup() error {
+	if mw.Logger == nil {
+		mw.Logger = stdLogger{}
+	}
+	if mw.Realm == "" && mw.RealmFunc == nil {
+		return errors.New("Realm is required")
+	}
+	// the key files are read first, so that their key type selects the default algorithm
+	if err := mw.readKeyFiles(); err != nil {
+		return fmt.Errorf("Can't read key file: %v", err)
 	}
 	if mw.SigningAlgorithm == "" {
-		mw.SigningAlgorithm = "HS256"
+		mw.SigningAlgorithm = mw.inferSigningAlgorithm()
+	}
+	if mw.SigningAlgorithm == jwt.SigningMethodNone.Alg() {
+		return errors.New("SigningAlgorithm none is not allowed")
+	}
+	if mw.signingMethod = jwt.GetSigningMethod(mw.SigningAlgorithm); mw.signingMethod == nil {
+		return errors.New("Invalid SigningAlgorithm " + mw.SigningAlgorithm)
+	}
+	if err := mw.checkSigningKeyType(); err != nil {
+		return err
+	}
+	if len(mw.VerificationAlgorithms) == 0 {
+		mw.VerificationAlgorithms = []string{mw.SigningAlgorithm}
+	}
+	if !mw.acceptsAlgorithm(mw.SigningAlgorithm) {
+		return errors.New("VerificationAlgorithms must contain SigningAlgorithm")
+	}
+	for _, alg := range mw.VerificationAlgorithms {
+		if alg == jwt.SigningMethodNone.Alg() || jwt.GetSigningMethod(alg) == nil {
+			return errors.New("Invalid verification algorithm " + alg)
+		}
+	}
+	if mw.KeyString != "" {
+		if mw.Key != nil {
+			return errors.New("Key and KeyString can't both be set")
+		}
+		mw.Key = []byte(mw.KeyString)
+	}
+	if mw.KeyFunc != nil {
+		// the verification keys are provided on demand
+	} else if mw.JWKSURL != "" {
+		if !mw.verifiesAlgoFamily("RS") && !mw.verifiesAlgoFamily("ES") {
+			return errors.New("JWKSURL requires an RS or ES verification algorithm")
+		}
+		if mw.JWKSRefreshInterval == 0 {
+			mw.JWKSRefreshInterval = time.Hour
+		}
+		mw.jwks = newJWKSCache(mw.JWKSURL, mw.JWKSRefreshInterval, mw.Logger)
+	} else {
+		if mw.verifiesAlgoFamily("RS") {
+			if mw.PubKey == nil && mw.PrivKey != nil {
+				mw.PubKey = &mw.PrivKey.PublicKey
+			}
+			if mw.PubKey == nil {
+				return errors.New("PrivKey or PubKey required for RS algorithms")
+			}
+		}
+		if mw.verifiesAlgoFamily("ES") {
+			if mw.ECPubKey == nil && mw.ECPrivKey != nil {
+				mw.ECPubKey = &mw.ECPrivKey.PublicKey
+			}
+			if mw.ECPubKey == nil {
+				return errors.New("ECPrivKey or ECPubKey required for ES algorithms")
+			}
+		}
+	}
+	if mw.KeyForTenant != nil {
+		if !strings.HasPrefix(mw.SigningAlgorithm, "HS") {
+			return errors.New("KeyForTenant requires an HS SigningAlgorithm")
+		}
+		if len(mw.Keys) != 0 {
+			return errors.New("KeyForTenant and Keys can't both be set")
+		}
+		if mw.TenantClaim == "" {
+			mw.TenantClaim = "tenant"
+		}
+	}
+	if mw.KeyFunc == nil && mw.KeyForTenant == nil && mw.verifiesAlgoFamily("HS") {
+		if len(mw.Keys) != 0 {
+			if _, ok := mw.Keys[mw.ActiveKID]; !ok {
+				return errors.New("ActiveKID must be one of Keys")
+			}
+		} else if mw.Key == nil {
+			return errors.New("Key required")
+		}
+	}
+	if mw.KeyFunc == nil && mw.KeyForTenant == nil && !mw.AllowWeakKey {
+		if err := mw.checkHMACKeyLengths(); err != nil {
+			return err
+		}
+	}
+	if mw.EncryptionKey != nil {
+		if mw.EncryptionAlgorithm == "" {
+			mw.EncryptionAlgorithm = "A256GCM"
+		}
+		size, ok := jweKeySizes[mw.EncryptionAlgorithm]
+		if !ok {
+			return errors.New("Invalid EncryptionAlgorithm " + mw.EncryptionAlgorithm)
+		}
+		if len(mw.EncryptionKey) != size {
+			return fmt.Errorf("EncryptionKey must be %d bytes long for %s", size, mw.EncryptionAlgorithm)
+		}
+	}
+	if mw.TokenLookup == "" {
+		mw.TokenLookup = "header:Authorization"
+	}
+	if mw.TokenQueryParam != "" && !mw.looksUp("query", mw.TokenQueryParam) {
+		mw.TokenLookup += ",query:" + mw.TokenQueryParam
+	}
+	for _, lookup := range mw.tokenLookups() {
+		if lookup.name == "" || (lookup.source != "header" && lookup.source != "cookie" && lookup.source != "query" && lookup.source != "protocol") {
+			return errors.New("Invalid TokenLookup " + mw.TokenLookup)
+		}
+	}
+	cookieOptions := CookieOptions{}
+	if mw.CookieOptions != nil {
+		cookieOptions = *mw.CookieOptions
+	}
+	if !cookieOptions.AllowInsecure {
+		cookieOptions.Secure = true
+	}
+	if !cookieOptions.AllowScriptAccess {
+		cookieOptions.HttpOnly = true
+	}
+	if cookieOptions.Path == "" {
+		cookieOptions.Path = "/"
+	}
+	if cookieOptions.SameSite == 0 {
+		cookieOptions.SameSite = http.SameSiteLaxMode
+	}
+	if cookieOptions.SameSite == http.SameSiteNoneMode && !cookieOptions.Secure {
+		return errors.New("CookieOptions with SameSite=None must be Secure")
 	}
-	if mw.Key == nil {
-		log.Fatal("Key required")
+	mw.CookieOptions = &cookieOptions
+	if mw.TokenHeadName == "" {
+		mw.TokenHeadName = "Bearer"
+	}
+	if mw.MaxTokenLength == 0 {
+		mw.MaxTokenLength = 4096
+	}
+	if mw.IdentityKey == "" {
+		mw.IdentityKey = "id"
+	}
+	if mw.OrigIatKey == "" {
+		mw.OrigIatKey = "orig_iat"
+	}
+	if mw.UsernameField == "" {
+		mw.UsernameField = "username"
+	}
+	if mw.PasswordField == "" {
+		mw.PasswordField = "password"
+	}
+	if mw.AuditWriter != nil {
+		mw.auditor = newAuditor(mw.AuditWriter, mw.Logger)
+	}
+	if mw.IntrospectionURL != "" {
+		mw.introspector = newIntrospector(mw.IntrospectionURL, mw.IntrospectionClientID, mw.IntrospectionClientSecret, mw.IdentityKey, mw.Logger)
 	}
 	if mw.Timeout == 0 {
 		mw.Timeout = time.Hour
 	}
-	if mw.Authenticator == nil {
-		log.Fatal("Authenticator is required")
+	if mw.TimeFunc == nil {
+		mw.TimeFunc = time.Now
+	}
+	if mw.MaxSessionsPerUser != 0 {
+		if mw.MaxSessionsPerUser < 0 {
+			return errors.New("MaxSessionsPerUser can't be negative")
+		}
+		if _, ok := mw.TokenStore.(UserTokenStore); !ok {
+			return errors.New("MaxSessionsPerUser requires a UserTokenStore")
+		}
+	}
+	if mw.SessionStore != nil && mw.MaxRefresh == 0 {
+		return errors.New("SessionStore requires MaxRefresh")
+	}
+	if mw.SlidingExpiration {
+		if mw.MaxRefresh == 0 {
+			return errors.New("SlidingExpiration requires MaxRefresh")
+		}
+		if mw.TokenResponseHeader == "" && mw.tokenCookieName() == "" {
+			return errors.New("SlidingExpiration requires TokenResponseHeader or a cookie TokenLookup")
+		}
+		if mw.SlidingWindow == 0 {
+			mw.SlidingWindow = mw.Timeout / 2
+		}
+	}
+	if mw.JTIFunc == nil {
+		mw.JTIFunc = newJTI
+	}
+	if mw.Metrics == nil {
+		mw.Metrics = noopMetrics{}
+	}
+	if mw.Authenticator == nil && mw.AuthenticatorWithRequest == nil && mw.AuthenticatorWithContext == nil && mw.LoginPayloadFunc == nil {
+		return errors.New("Authenticator is required")
 	}
 	if mw.Authorizator == nil {
 		mw.Authorizator = func(userId string, request *rest.Request) bool {
@@ -73,125 +956,1828 @@ func (mw *JWTMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFu
 		}
 	}
 
-	return func(writer rest.ResponseWriter, request *rest.Request) { mw.middlewareImpl(writer, request, handler) }
+	mw.initialized = true
+	return nil
 }
 
-func (mw *JWTMiddleware) middlewareImpl(writer rest.ResponseWriter, request *rest.Request, handler rest.HandlerFunc) {
-	token, err := parseToken(request, mw.Key)
+// checkHMACKeyLengths returns an error when Key, or one of Keys, is shorter than the minimum
+// length of the HS algorithms of VerificationAlgorithms, see minHMACKeyLengths.
+func (mw *JWTMiddleware) checkHMACKeyLengths() error {
+	var minLength int
+	var minAlg string
+	for _, alg := range mw.VerificationAlgorithms {
+		if length := minHMACKeyLengths[alg]; length > minLength {
+			minLength, minAlg = length, alg
+		}
+	}
 
-	if err != nil {
-		mw.unauthorized(writer)
-		return
+	for kid, key := range mw.Keys {
+		if len(key) < minLength {
+			return fmt.Errorf("Key %s is too short for %s, at least %d bytes are required", kid, minAlg, minLength)
+		}
+	}
+	if len(mw.Keys) == 0 && len(mw.Key) < minLength {
+		return fmt.Errorf("Key is too short for %s, at least %d bytes are required", minAlg, minLength)
 	}
+	return nil
+}
 
-	id := token.Claims["id"].(string)
+// checkTenantKeyLength returns an error when the key returned by KeyForTenant for tenant is
+// shorter than the minimum length of alg, as checkHMACKeyLengths does for Key on setup.
+func (mw *JWTMiddleware) checkTenantKeyLength(tenant string, key []byte, alg string) error {
+	if minLength := minHMACKeyLengths[alg]; !mw.AllowWeakKey && len(key) < minLength {
+		return fmt.Errorf("Key of tenant %s is too short for %s, at least %d bytes are required", tenant, alg, minLength)
+	}
+	return nil
+}
 
-	if !mw.Authorizator(id, request) {
-		mw.unauthorized(writer)
-		return
+// inferSigningAlgorithm returns the default SigningAlgorithm for the type of the configured keys.
+// Public keys alone only select their algorithm for verifying services without any secret key.
+func (mw *JWTMiddleware) inferSigningAlgorithm() string {
+	hasSecret := mw.Key != nil || mw.KeyString != "" || len(mw.Keys) != 0 || mw.KeyForTenant != nil
+	switch {
+	case mw.PrivKey != nil:
+		return "RS256"
+	case mw.ECPrivKey != nil:
+		return ecdsaAlgorithm(&mw.ECPrivKey.PublicKey)
+	case hasSecret:
+		return "HS256"
+	case mw.PubKey != nil:
+		return "RS256"
+	case mw.ECPubKey != nil:
+		return ecdsaAlgorithm(mw.ECPubKey)
 	}
+	return "HS256"
+}
 
-	request.Env["REMOTE_USER"] = id
-	handler(writer, request)
+// ecdsaAlgorithm returns the ES algorithm using the curve of key, see RFC 7518.
+func ecdsaAlgorithm(key *ecdsa.PublicKey) string {
+	switch key.Curve.Params().BitSize {
+	case 384:
+		return "ES384"
+	case 521:
+		return "ES512"
+	}
+	return "ES256"
 }
 
-type login struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+// checkSigningKeyType rejects a SigningAlgorithm that can't be used with the configured private
+// key, e.g. RS256 with only an ECPrivKey, or ES384 with a P-256 key.
+func (mw *JWTMiddleware) checkSigningKeyType() error {
+	switch {
+	case mw.usingRSAAlgo() && mw.PrivKey == nil && mw.ECPrivKey != nil:
+		return errors.New("SigningAlgorithm " + mw.SigningAlgorithm + " requires an RSA key, not ECPrivKey")
+	case mw.usingECDSAAlgo() && mw.ECPrivKey == nil && mw.PrivKey != nil:
+		return errors.New("SigningAlgorithm " + mw.SigningAlgorithm + " requires an ECDSA key, not PrivKey")
+	case mw.usingECDSAAlgo() && mw.ECPrivKey != nil && ecdsaAlgorithm(&mw.ECPrivKey.PublicKey) != mw.SigningAlgorithm:
+		return errors.New("SigningAlgorithm " + mw.SigningAlgorithm + " doesn't match the curve of ECPrivKey")
+	}
+	return nil
 }
 
-// Handler that clients can use to get a jwt token.
-// Payload needs to be json in the form of {"username": "USERNAME", "password": "PASSWORD"}.
-// Reply will be of the form {"token": "TOKEN"}.
-func (mw *JWTMiddleware) LoginHandler(writer rest.ResponseWriter, request *rest.Request) {
-	login_vals := login{}
-	err := request.DecodeJsonPayload(&login_vals)
+// readKeyFiles parses PrivKeyFile into the private key of SigningAlgorithm, and PubKeyFile into
+// the public key of the RS or ES algorithm of VerificationAlgorithms. It runs before the
+// algorithms get their defaults: without them, the key is parsed as RSA or else as ECDSA, and
+// inferSigningAlgorithm then picks the algorithm of its type.
+func (mw *JWTMiddleware) readKeyFiles() error {
+	if mw.PrivKeyFile != "" {
+		data, err := ioutil.ReadFile(mw.PrivKeyFile)
+		if err != nil {
+			return err
+		}
+		if mw.usingRSAAlgo() {
+			mw.PrivKey, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+		} else if mw.usingECDSAAlgo() {
+			mw.ECPrivKey, err = jwt.ParseECPrivateKeyFromPEM(data)
+		} else if mw.SigningAlgorithm == "" {
+			if mw.PrivKey, err = jwt.ParseRSAPrivateKeyFromPEM(data); err != nil {
+				mw.PrivKey = nil
+				if mw.ECPrivKey, err = jwt.ParseECPrivateKeyFromPEM(data); err != nil {
+					mw.ECPrivKey = nil
+					err = errors.New("PrivKeyFile holds neither an RSA nor an ECDSA private key")
+				}
+			}
+		} else {
+			err = errors.New("PrivKeyFile requires an RS or ES SigningAlgorithm")
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-	if err != nil {
-		mw.unauthorized(writer)
-		return
+	if mw.PubKeyFile != "" {
+		data, err := ioutil.ReadFile(mw.PubKeyFile)
+		if err != nil {
+			return err
+		}
+		algorithms := mw.VerificationAlgorithms
+		if len(algorithms) == 0 && mw.SigningAlgorithm != "" {
+			algorithms = []string{mw.SigningAlgorithm}
+		}
+		if containsAlgoFamily(algorithms, "RS") {
+			mw.PubKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		} else if containsAlgoFamily(algorithms, "ES") {
+			mw.ECPubKey, err = jwt.ParseECPublicKeyFromPEM(data)
+		} else if len(algorithms) == 0 {
+			if mw.PubKey, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+				mw.PubKey = nil
+				if mw.ECPubKey, err = jwt.ParseECPublicKeyFromPEM(data); err != nil {
+					mw.ECPubKey = nil
+					err = errors.New("PubKeyFile holds neither an RSA nor an ECDSA public key")
+				}
+			}
+		} else {
+			err = errors.New("PubKeyFile requires an RS or ES SigningAlgorithm")
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	if !mw.Authenticator(login_vals.Username, login_vals.Password) {
-		mw.unauthorized(writer)
+	return nil
+}
+
+func (mw *JWTMiddleware) middlewareImpl(writer rest.ResponseWriter, request *rest.Request, handler rest.HandlerFunc) {
+	if (mw.AllowPreflight && request.Method == http.MethodOptions) || (mw.Skipper != nil && mw.Skipper(request)) {
+		handler(writer, request)
 		return
 	}
 
-	token := jwt.New(jwt.GetSigningMethod(mw.SigningAlgorithm))
-	token.Claims["id"] = login_vals.Username
-	token.Claims["exp"] = time.Now().Add(mw.Timeout).Unix()
-	if mw.MaxRefresh != 0 {
-		token.Claims["orig_iat"] = time.Now().Unix()
-	}
-	tokenString, err := token.SignedString(mw.Key)
+	start := time.Now()
+	claims, err := mw.ParseRequest(request)
+	mw.Metrics.ObserveValidationDuration(time.Since(start))
 
 	if err != nil {
-		mw.unauthorized(writer)
+		if mw.Optional {
+			handler(writer, request)
+			return
+		}
+		mw.deny(writer, request, "", err)
 		return
 	}
 
-	writer.WriteJson(&map[string]string{"token": tokenString})
-}
+	id := claims[mw.IdentityKey].(string)
 
-func parseToken(request *rest.Request, key []byte) (*jwt.Token, error) {
-	authHeader := request.Header.Get("Authorization")
+	if err := mw.checkClaims(claims, request); err != nil {
+		mw.deny(writer, request, id, err)
+		return
+	}
 
-	if authHeader == "" {
-		return nil, errors.New("Auth header empty")
+	if err := mw.authorize(id, request); err != nil {
+		if mw.OnAuthorizationDenied != nil {
+			mw.OnAuthorizationDenied(id, request)
+		}
+		mw.deny(writer, request, id, err)
+		return
 	}
 
-	parts := strings.SplitN(authHeader, " ", 2)
-	if !(len(parts) == 2 && parts[0] == "Bearer") {
-		return nil, errors.New("Invalid auth header")
+	// one-time tokens are only consumed by authorized requests
+	if err := mw.consumeOneTime(claims); err != nil {
+		mw.deny(writer, request, id, err)
+		return
 	}
 
-	return jwt.Parse(parts[1], func(token *jwt.Token) (interface{}, error) {
-		return key, nil
-	})
-}
+	mw.Metrics.IncAuthSuccess()
+
+	if mw.SlidingExpiration {
+		mw.slideExpiration(writer, id, claims)
+	}
+
+	mw.echoProtocol(writer, request)
+
+	request.Request = request.WithContext(newContext(request.Context(), id, claims))
+	request.Env["REMOTE_USER"] = id
+	request.Env["JWT_PAYLOAD"] = claims
+	if exp, ok := numericClaim(claims, "exp"); ok {
+		request.Env["JWT_EXPIRES_IN"] = time.Unix(exp, 0).Sub(mw.TimeFunc())
+	}
+	if mw.OnAuthorized != nil {
+		mw.OnAuthorized(id, request)
+	}
+	handler(writer, request)
+}
+
+// deny rejects a request of the middleware, recording the reason.
+func (mw *JWTMiddleware) deny(writer rest.ResponseWriter, request *rest.Request, userId string, reason error) {
+	mw.Metrics.IncAuthFailure(reason.Error())
+	mw.audit(AuditDenied, userId, request, reason)
+	mw.unauthorized(writer, request, reason)
+}
+
+// slideExpiration reissues the token when it expires within SlidingWindow and is still
+// refreshable. Failures are ignored, the current token stays valid until it expires.
+func (mw *JWTMiddleware) slideExpiration(writer rest.ResponseWriter, userId string, claims map[string]interface{}) {
+	exp, ok := numericClaim(claims, "exp")
+	if !ok || time.Unix(exp, 0).Sub(mw.TimeFunc()) > mw.SlidingWindow {
+		return
+	}
+
+	origIat, ok := numericClaim(claims, mw.OrigIatKey)
+	if !ok || origIat < mw.TimeFunc().Add(-mw.MaxRefresh).Unix() || mw.checkSession(claims) != nil {
+		return
+	}
+
+	tokenString, expire, err := mw.createToken(userId, mw.sessionOf(claims))
+	if err != nil {
+		mw.Logger.Printf("jwt: can't create token: %v", err)
+		return
+	}
+
+	mw.setTokenHeaders(writer, tokenString, expire)
+}
+
+// ParseRequest extracts the token from the request, as configured by TokenLookup, and performs
+// the same validation as the middleware, except for the authorization. Returns the claims of the
+// token, which are guaranteed to contain a string identity under IdentityKey. This allows other
+// middlewares and handlers to reuse the token validation. No response is written on failure.
+func (mw *JWTMiddleware) ParseRequest(request *rest.Request) (map[string]interface{}, error) {
+	token, err := mw.parseToken(request, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := token.Claims[mw.IdentityKey].(string); !ok {
+		return nil, ErrInvalidIdentity
+	}
+
+	return token.Claims, nil
+}
+
+// IdentityIfPresent returns the identity of the request when it carries a valid token, checked
+// like ParseRequest plus the RequiredClaims and the ClaimsValidator, and false otherwise. This
+// allows handlers outside of the middleware to optionally identify the user. A one-time token is
+// consumed, unless the middleware already did. No response is written.
+func (mw *JWTMiddleware) IdentityIfPresent(request *rest.Request) (string, bool) {
+	claims, err := mw.ParseRequest(request)
+	if err != nil || mw.checkClaims(claims, request) != nil || mw.consumeRequestOneTime(request, claims) != nil {
+		return "", false
+	}
+	return claims[mw.IdentityKey].(string), true
+}
+
+// BindClaims unmarshals the claims of the request into dst, a pointer to a struct using json
+// tags, e.g. to read custom claims into typed fields instead of asserting the types of
+// JWT_PAYLOAD. The claims set by the middleware are used, or else those of ParseRequest, whose
+// one-time token is then consumed.
+func (mw *JWTMiddleware) BindClaims(request *rest.Request, dst interface{}) error {
+	claims, ok := request.Env["JWT_PAYLOAD"].(map[string]interface{})
+	if !ok {
+		var err error
+		if claims, err = mw.ParseRequest(request); err != nil {
+			return err
+		}
+		if err = mw.consumeOneTime(claims); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// allowLogin asks the LoginRateLimiter whether a login attempt of userId may be made, setting the
+// Retry-After header when it's denied.
+func (mw *JWTMiddleware) allowLogin(writer rest.ResponseWriter, userId string, request *rest.Request) bool {
+	if mw.LoginRateLimiter == nil || mw.LoginRateLimiter.Allow(userId, clientIP(request)) {
+		return true
+	}
+	if limiter, ok := mw.LoginRateLimiter.(retryAfterer); ok {
+		setRetryAfter(writer, limiter.RetryAfter(userId, clientIP(request)))
+	}
+	return false
+}
+
+type login struct {
+	Username string
+	Password string
+}
+
+// loginUser extracts and authenticates the user of a login request. On failure, the returned
+// userId is the one submitted, if any. The Retry-After header of a throttled attempt is set on
+// writer.
+func (mw *JWTMiddleware) loginUser(writer rest.ResponseWriter, request *rest.Request) (string, error) {
+	if mw.LoginPayloadFunc != nil {
+		if !mw.allowLogin(writer, "", request) {
+			return "", ErrTooManyLoginAttempts
+		}
+
+		userId, ok := mw.LoginPayloadFunc(request)
+		if !ok {
+			return userId, ErrFailedAuthentication
+		}
+		return userId, nil
+	}
+
+	login_vals, err := mw.decodeLogin(request)
+
+	if err == rest.ErrJsonPayloadEmpty && mw.BasicAuthLogin {
+		if username, password, ok := request.BasicAuth(); ok {
+			login_vals, err = login{Username: username, Password: password}, nil
+		}
+	}
+
+	if err != nil {
+		return "", ErrInvalidLoginPayload
+	}
+
+	if !mw.allowLogin(writer, login_vals.Username, request) {
+		return login_vals.Username, ErrTooManyLoginAttempts
+	}
+
+	if err := mw.authenticate(login_vals.Username, login_vals.Password, request); err != nil {
+		return login_vals.Username, err
+	}
+
+	return login_vals.Username, nil
+}
+
+// decodeLogin decodes the credentials of the json payload from UsernameField and PasswordField.
+func (mw *JWTMiddleware) decodeLogin(request *rest.Request) (login, error) {
+	payload := map[string]interface{}{}
+	if err := request.DecodeJsonPayload(&payload); err != nil {
+		return login{}, err
+	}
+
+	username, usernameOk := loginField(payload, mw.UsernameField)
+	password, passwordOk := loginField(payload, mw.PasswordField)
+	if !usernameOk || !passwordOk {
+		return login{}, ErrInvalidLoginPayload
+	}
+	return login{Username: username, Password: password}, nil
+}
+
+// loginField returns the string value of field, which may be missing, and false when it isn't a
+// string.
+func loginField(payload map[string]interface{}, field string) (string, bool) {
+	if payload[field] == nil {
+		return "", true
+	}
+	value, ok := payload[field].(string)
+	return value, ok
+}
+
+// clientIP returns the ip address of the client, without the port.
+func clientIP(request *rest.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Handler that clients can use to get a jwt token.
+// Payload needs to be json in the form of {"username": "USERNAME", "password": "PASSWORD"}, the
+// field names can be changed with UsernameField and PasswordField.
+// Reply will be of the form {"token": "TOKEN", "expire": "2006-01-02T15:04:05Z07:00"}, with an
+// additional "user" object when LoginResponseClaims is set.
+// When the token is read from a cookie, see TokenLookup, it's also set in that cookie.
+// When BasicAuthLogin is set, the credentials can also be passed as HTTP Basic credentials.
+// When LoginPayloadFunc is set, it replaces the above payload and the Authenticator.
+func (mw *JWTMiddleware) LoginHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.LoginEnabled != nil && !mw.LoginEnabled() {
+		mw.audit(AuditLogin, "", request, ErrLoginDisabled)
+		mw.unauthorized(writer, request, ErrLoginDisabled)
+		return
+	}
+
+	userId, err := mw.loginUser(writer, request)
+
+	if err == nil && mw.IdentityMapper != nil {
+		if identity, ok := mw.IdentityMapper(userId); ok {
+			userId = identity
+		} else {
+			err = ErrFailedAuthentication
+		}
+	}
+
+	if err != nil {
+		if mw.OnLoginFailure != nil {
+			mw.OnLoginFailure(userId, request)
+		}
+		mw.Metrics.IncLoginFailure(err.Error())
+		mw.audit(AuditLogin, userId, request, err)
+		mw.unauthorized(writer, request, err)
+		return
+	}
+
+	tokenString, expire, refreshTokenString, err := mw.generateTokens(userId, mw.fingerprint(request))
+
+	if err != nil {
+		mw.Logger.Printf("jwt: can't create token: %v", err)
+		mw.audit(AuditLogin, userId, request, ErrFailedTokenCreation)
+		mw.unauthorized(writer, request, ErrFailedTokenCreation)
+		return
+	}
+
+	mw.evictSessions(userId)
+
+	if mw.OnLoginSuccess != nil {
+		mw.OnLoginSuccess(userId, request)
+	}
+	mw.Metrics.IncLoginSuccess()
+	mw.audit(AuditLogin, userId, request, nil)
+
+	mw.loginResponse(writer, http.StatusOK, tokenString, expire, refreshTokenString, mw.loginResponseUser(userId))
+}
+
+// evictSessions deletes the oldest sessions of userId from the TokenStore beyond
+// MaxSessionsPerUser.
+func (mw *JWTMiddleware) evictSessions(userId string) {
+	if mw.MaxSessionsPerUser == 0 {
+		return
+	}
+
+	sessions := []string{}
+	for _, key := range mw.TokenStore.(UserTokenStore).Tokens(userId) {
+		if strings.HasPrefix(key, sessionKeyPrefix) {
+			sessions = append(sessions, key)
+		}
+	}
+	for len(sessions) > mw.MaxSessionsPerUser {
+		if err := mw.TokenStore.Delete(sessions[0]); err != nil {
+			mw.Logger.Printf("jwt: can't evict session of %s: %v", userId, err)
+		}
+		sessions = sessions[1:]
+	}
+}
+
+// loginResponseUser returns the LoginResponseClaims of the PayloadFunc for userId, or nil.
+func (mw *JWTMiddleware) loginResponseUser(userId string) map[string]interface{} {
+	if len(mw.LoginResponseClaims) == 0 || mw.PayloadFunc == nil || mw.LoginResponseFunc != nil {
+		return nil
+	}
+
+	claims := mw.PayloadFunc(userId)
+	user := map[string]interface{}{}
+	for _, claim := range mw.LoginResponseClaims {
+		if value, ok := claims[claim]; ok {
+			user[claim] = value
+		}
+	}
+	return user
+}
+
+// GenerateOneTimeToken creates a signed token for userId, valid for timeout, that the middleware
+// accepts only once, e.g. for password reset or email verification links. It carries the
+// one_time claim, can't be refreshed and requires OneTimeTokenStore. Returns the token and its
+// expiry time.
+func (mw *JWTMiddleware) GenerateOneTimeToken(userId string, timeout time.Duration) (string, time.Time, error) {
+	if mw.OneTimeTokenStore == nil {
+		return "", time.Time{}, errors.New("OneTimeTokenStore required for one-time tokens")
+	}
+
+	token := mw.newToken()
+	mw.setIdentity(token, userId)
+	expire := mw.TimeFunc().Add(timeout)
+	token.Claims["exp"] = expire.Unix()
+	token.Claims["one_time"] = true
+	if err := mw.setTokenVersion(token, userId); err != nil {
+		return "", expire, err
+	}
+	mw.setRegisteredClaims(token)
+
+	tokenString, err := mw.signToken(token)
+	if err != nil {
+		return "", expire, err
+	}
+
+	if mw.TokenStore != nil {
+		if err := mw.TokenStore.Save(token.Claims["jti"].(string), userId, expire); err != nil {
+			return "", expire, err
+		}
+	}
+	return tokenString, expire, nil
+}
+
+// consumeOneTime consumes the token in the OneTimeTokenStore when it's a one-time token, failing
+// if it was already used.
+func (mw *JWTMiddleware) consumeOneTime(claims map[string]interface{}) error {
+	if claims["one_time"] != true {
+		return nil
+	}
+	if mw.OneTimeTokenStore == nil {
+		return ErrInvalidTokenType
+	}
+
+	jti, _ := claims["jti"].(string)
+	exp, _ := numericClaim(claims, "exp")
+	if jti == "" || !mw.OneTimeTokenStore.Consume(jti, time.Unix(exp, 0)) {
+		return ErrTokenAlreadyUsed
+	}
+	return nil
+}
+
+// consumeRequestOneTime consumes the one-time token of claims, validated outside of the
+// middleware, unless the middleware already consumed it for this request.
+func (mw *JWTMiddleware) consumeRequestOneTime(request *rest.Request, claims map[string]interface{}) error {
+	if payload, ok := request.Env["JWT_PAYLOAD"].(map[string]interface{}); ok && payload["jti"] != nil && payload["jti"] == claims["jti"] {
+		return nil
+	}
+	return mw.consumeOneTime(claims)
+}
+
+// GenerateToken creates a signed token for userId outside of the HTTP flow, e.g. for tests,
+// command line tools or server to server calls. The token carries the same claims as the ones
+// issued by LoginHandler. Returns the token and its expiry time.
+func (mw *JWTMiddleware) GenerateToken(userId string) (string, time.Time, error) {
+	tokenString, expire, _, err := mw.generateTokens(userId, "")
+	return tokenString, expire, err
+}
+
+// generateTokens starts a new session of userId, bound to the client fingerprint, if any, and
+// signs its first access token and, with RefreshTokenTimeout, its refresh token.
+func (mw *JWTMiddleware) generateTokens(userId string, fingerprint string) (string, time.Time, string, error) {
+	session, err := mw.startSession(userId, fingerprint)
+	if err != nil {
+		return "", time.Time{}, "", err
+	}
+
+	tokenString, expire, err := mw.createToken(userId, session)
+	if err != nil || mw.RefreshTokenTimeout == 0 {
+		return tokenString, expire, "", err
+	}
+
+	refreshTokenString, err := mw.createRefreshToken(userId, session)
+	return tokenString, expire, refreshTokenString, err
+}
+
+// startSession starts the session of a login of userId, creating it in the SessionStore.
+func (mw *JWTMiddleware) startSession(userId string, fingerprint string) (tokenSession, error) {
+	session := tokenSession{fingerprint: fingerprint}
+	if mw.MaxRefresh != 0 {
+		session.origIat = mw.TimeFunc().Unix()
+	}
+	if mw.SessionStore != nil || mw.TokenStore != nil {
+		session.id = mw.JTIFunc()
+	}
+	if mw.SessionStore != nil {
+		lifetime := mw.MaxRefresh + mw.RefreshGracePeriod
+		if mw.RefreshTokenTimeout > lifetime {
+			lifetime = mw.RefreshTokenTimeout
+		}
+		if err := mw.SessionStore.Create(session.id, userId, mw.TimeFunc().Add(lifetime)); err != nil {
+			return session, err
+		}
+	}
+	return session, nil
+}
+
+// sessionKeyPrefix prefixes the sid of the sessions recorded in the TokenStore, keeping them
+// apart from the jti of the tokens.
+const sessionKeyPrefix = "sid:"
+
+// storeSession records the session of a token issued to userId in the TokenStore, until the
+// expiry of the longest lived token that can be issued now.
+func (mw *JWTMiddleware) storeSession(userId string, session tokenSession) error {
+	if mw.TokenStore == nil || session.id == "" {
+		return nil
+	}
+
+	lifetime := mw.Timeout
+	if refresh := mw.MaxRefresh + mw.RefreshGracePeriod; refresh > lifetime {
+		lifetime = refresh
+	}
+	if mw.RefreshTokenTimeout > lifetime {
+		lifetime = mw.RefreshTokenTimeout
+	}
+	return mw.TokenStore.Save(sessionKeyPrefix+session.id, userId, mw.TimeFunc().Add(lifetime))
+}
+
+// sessionStored reports whether the session of the claims, if any, is still recorded in the
+// TokenStore.
+func (mw *JWTMiddleware) sessionStored(claims map[string]interface{}) bool {
+	sid, ok := claims["sid"].(string)
+	return !ok || mw.TokenStore.Exists(sessionKeyPrefix+sid)
+}
+
+// tokenSession holds the claims that are carried from a token to its refreshed ones.
+type tokenSession struct {
+	// start of the session, in the OrigIatKey claim, bounding the refreshes
+	origIat int64
+	// client fingerprint, in the fgp claim
+	fingerprint string
+	// id of the session in the SessionStore, in the sid claim
+	id string
+}
+
+// sessionOf returns the session carried by the claims of a token.
+func (mw *JWTMiddleware) sessionOf(claims map[string]interface{}) tokenSession {
+	origIat, _ := numericClaim(claims, mw.OrigIatKey)
+	fingerprint, _ := claims["fgp"].(string)
+	id, _ := claims["sid"].(string)
+	return tokenSession{origIat, fingerprint, id}
+}
+
+// checkSession rejects tokens whose session isn't active in the SessionStore, or was deleted from
+// the TokenStore.
+func (mw *JWTMiddleware) checkSession(claims map[string]interface{}) error {
+	if mw.TokenStore != nil && !mw.sessionStored(claims) {
+		return ErrInactiveSession
+	}
+	if mw.SessionStore == nil {
+		return nil
+	}
+	if sid, ok := claims["sid"].(string); !ok || !mw.SessionStore.IsActive(sid) {
+		return ErrInactiveSession
+	}
+	return nil
+}
+
+// createToken signs a new access token for userId, carrying the non-zero claims of the session.
+func (mw *JWTMiddleware) createToken(userId string, session tokenSession) (string, time.Time, error) {
+	token := mw.newToken()
+
+	if mw.PayloadFunc != nil {
+		for key, value := range mw.PayloadFunc(userId) {
+			if !mw.isReservedClaim(key) {
+				token.Claims[key] = value
+			}
+		}
+	}
+
+	mw.setIdentity(token, userId)
+	expire := mw.TimeFunc().Add(mw.Timeout)
+	token.Claims["exp"] = expire.Unix()
+	if session.origIat != 0 {
+		token.Claims[mw.OrigIatKey] = session.origIat
+	}
+	if session.fingerprint != "" {
+		token.Claims["fgp"] = session.fingerprint
+	}
+	if session.id != "" {
+		token.Claims["sid"] = session.id
+	}
+	if err := mw.setTokenVersion(token, userId); err != nil {
+		return "", expire, err
+	}
+	mw.setRegisteredClaims(token)
+
+	tokenString, err := mw.signToken(token)
+	if err != nil {
+		return "", expire, err
+	}
+
+	if mw.TokenStore != nil {
+		if err := mw.TokenStore.Save(token.Claims["jti"].(string), userId, mw.storedUntil(expire, session)); err != nil {
+			return "", expire, err
+		}
+	}
+	if err := mw.storeSession(userId, session); err != nil {
+		return "", expire, err
+	}
+	return tokenString, expire, nil
+}
+
+// reservedClaims are the claims set by the middleware, that PayloadFunc can't override.
+var reservedClaims = map[string]bool{
+	"sub": true, "exp": true, "fgp": true, "sid": true, "one_time": true, "token_type": true,
+	"ver": true, "iat": true, "iss": true, "aud": true, "jti": true,
+}
+
+// isReservedClaim reports whether the claim key is set by the middleware.
+func (mw *JWTMiddleware) isReservedClaim(key string) bool {
+	return reservedClaims[key] || key == mw.IdentityKey || key == mw.OrigIatKey
+}
+
+// storedUntil returns how long the TokenStore must keep a token expiring at expire: until the end
+// of its refresh window when it can be refreshed after expiring.
+func (mw *JWTMiddleware) storedUntil(expire time.Time, session tokenSession) time.Time {
+	if mw.MaxRefresh == 0 || session.origIat == 0 {
+		return expire
+	}
+	if end := time.Unix(session.origIat, 0).Add(mw.MaxRefresh + mw.RefreshGracePeriod); end.After(expire) {
+		return end
+	}
+	return expire
+}
+
+// createRefreshToken signs a new refresh token for userId, see RefreshTokenTimeout, carrying the
+// non-zero claims of the session like the access tokens.
+func (mw *JWTMiddleware) createRefreshToken(userId string, session tokenSession) (string, error) {
+	token := mw.newToken()
+	mw.setIdentity(token, userId)
+	token.Claims["exp"] = mw.TimeFunc().Add(mw.RefreshTokenTimeout).Unix()
+	token.Claims["token_type"] = "refresh"
+	if session.origIat != 0 {
+		token.Claims[mw.OrigIatKey] = session.origIat
+	}
+	if session.fingerprint != "" {
+		token.Claims["fgp"] = session.fingerprint
+	}
+	if session.id != "" {
+		token.Claims["sid"] = session.id
+	}
+	if mw.KeyForTenant != nil && mw.PayloadFunc != nil {
+		// the refresh token is signed with the key of the tenant too
+		if tenant, ok := mw.PayloadFunc(userId)[mw.TenantClaim]; ok {
+			token.Claims[mw.TenantClaim] = tenant
+		}
+	}
+	if err := mw.setTokenVersion(token, userId); err != nil {
+		return "", err
+	}
+	mw.setRegisteredClaims(token)
+
+	if err := mw.storeSession(userId, session); err != nil {
+		return "", err
+	}
+	return mw.signToken(token)
+}
+
+// setTokenVersion stamps the current token version of userId in the ver claim.
+func (mw *JWTMiddleware) setTokenVersion(token *jwt.Token, userId string) error {
+	if mw.TokenVersionStore == nil {
+		return nil
+	}
+
+	version, err := mw.TokenVersionStore.Version(userId)
+	if err != nil {
+		return err
+	}
+	token.Claims["ver"] = version
+	return nil
+}
+
+// BumpTokenVersion invalidates all the tokens issued to userId so far, access and refresh tokens
+// alike, e.g. when they change their password. Their next login gets tokens of the new version.
+// Requires TokenVersionStore.
+func (mw *JWTMiddleware) BumpTokenVersion(userId string) error {
+	if mw.TokenVersionStore == nil {
+		return errors.New("TokenVersionStore required to bump token versions")
+	}
+
+	_, err := mw.TokenVersionStore.Bump(userId)
+	return err
+}
+
+// checkTokenVersion rejects tokens whose ver claim isn't the current version of their user.
+func (mw *JWTMiddleware) checkTokenVersion(claims map[string]interface{}) error {
+	if mw.TokenVersionStore == nil {
+		return nil
+	}
+
+	userId, _ := claims[mw.IdentityKey].(string)
+	tokenVersion, ok := numericClaim(claims, "ver")
+	if !ok {
+		return ErrRevokedToken
+	}
+
+	version, err := mw.TokenVersionStore.Version(userId)
+	if err != nil {
+		mw.Logger.Printf("jwt: can't get token version of %s: %v", userId, err)
+		return ErrInvalidToken
+	}
+	if tokenVersion != version {
+		return ErrRevokedToken
+	}
+	return nil
+}
+
+// signToken signs the token and encrypts it when EncryptionKey is set.
+func (mw *JWTMiddleware) signToken(token *jwt.Token) (string, error) {
+	key := mw.signingKey()
+	if mw.SigningKeyFunc != nil {
+		var err error
+		if key, err = mw.SigningKeyFunc(); err != nil {
+			return "", err
+		}
+	}
+	if mw.KeyForTenant != nil {
+		tenant, ok := token.Claims[mw.TenantClaim].(string)
+		if !ok {
+			return "", errors.New("missing " + mw.TenantClaim + " claim")
+		}
+		tenantKey, err := mw.KeyForTenant(tenant)
+		if err != nil {
+			return "", err
+		}
+		if err := mw.checkTenantKeyLength(tenant, tenantKey, mw.SigningAlgorithm); err != nil {
+			return "", err
+		}
+		key = tenantKey
+		token.Header["kid"] = tenant
+	}
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		return "", err
+	}
+	return mw.encryptToken(tokenString)
+}
+
+// setIdentity stores userId in the IdentityKey claim and, with SetSubject, in the sub claim.
+func (mw *JWTMiddleware) setIdentity(token *jwt.Token, userId string) {
+	token.Claims[mw.IdentityKey] = userId
+	if mw.SetSubject {
+		token.Claims["sub"] = userId
+	}
+}
+
+// setRegisteredClaims sets the iat, iss, aud and jti claims shared by all issued tokens. Unlike
+// orig_iat, which is kept across refreshes, iat is the time the token itself was issued.
+func (mw *JWTMiddleware) setRegisteredClaims(token *jwt.Token) {
+	token.Claims["iat"] = mw.TimeFunc().Add(-mw.IssuedAtBackdate).Unix()
+	if mw.Issuer != "" {
+		token.Claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" {
+		token.Claims["aud"] = mw.Audience
+	}
+	token.Claims["jti"] = mw.JTIFunc()
+}
+
+func (mw *JWTMiddleware) authenticate(userId string, password string, request *rest.Request) error {
+	if mw.AuthenticatorWithContext != nil {
+		ctx := request.Context()
+		ok, err := mw.AuthenticatorWithContext(ctx, userId, password)
+		if err != nil {
+			mw.Logger.Printf("jwt: can't authenticate %s: %v", userId, err)
+			return ErrAuthenticatorUnavailable
+		}
+		if !ok && ctx.Err() != nil {
+			return ErrAuthenticatorUnavailable
+		}
+		if !ok {
+			return ErrFailedAuthentication
+		}
+		return nil
+	}
+
+	var ok bool
+	if mw.AuthenticatorWithRequest != nil {
+		ok = mw.AuthenticatorWithRequest(userId, password, request)
+	} else {
+		ok = mw.Authenticator(userId, password)
+	}
+	if !ok {
+		return ErrFailedAuthentication
+	}
+	return nil
+}
+
+func (mw *JWTMiddleware) authorize(userId string, request *rest.Request) error {
+	if mw.AuthorizatorWithError != nil {
+		return mw.AuthorizatorWithError(userId, request)
+	}
+	if !mw.Authorizator(userId, request) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (mw *JWTMiddleware) usingRSAAlgo() bool {
+	return strings.HasPrefix(mw.SigningAlgorithm, "RS")
+}
+
+func (mw *JWTMiddleware) usingECDSAAlgo() bool {
+	return strings.HasPrefix(mw.SigningAlgorithm, "ES")
+}
+
+// verifiesAlgoFamily reports whether one of VerificationAlgorithms starts with prefix, e.g. "RS".
+func (mw *JWTMiddleware) verifiesAlgoFamily(prefix string) bool {
+	return containsAlgoFamily(mw.VerificationAlgorithms, prefix)
+}
+
+// containsAlgoFamily reports whether one of algorithms starts with prefix.
+func containsAlgoFamily(algorithms []string, prefix string) bool {
+	for _, alg := range algorithms {
+		if strings.HasPrefix(alg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mw *JWTMiddleware) acceptsAlgorithm(alg string) bool {
+	for _, accepted := range mw.VerificationAlgorithms {
+		if alg == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// newToken returns an unsigned token for the configured algorithm and key.
+func (mw *JWTMiddleware) newToken() *jwt.Token {
+	token := jwt.New(mw.signingMethod)
+	if len(mw.Keys) != 0 {
+		token.Header["kid"] = mw.ActiveKID
+	}
+	return token
+}
+
+// signingKey returns the key used to sign new tokens for the configured algorithm. A missing
+// private key is returned as an untyped nil so that signing fails instead of panicking.
+func (mw *JWTMiddleware) signingKey() interface{} {
+	if mw.usingRSAAlgo() {
+		if mw.PrivKey == nil {
+			return nil
+		}
+		return mw.PrivKey
+	}
+	if mw.usingECDSAAlgo() {
+		if mw.ECPrivKey == nil {
+			return nil
+		}
+		return mw.ECPrivKey
+	}
+	if len(mw.Keys) != 0 {
+		return mw.Keys[mw.ActiveKID]
+	}
+	return mw.Key
+}
+
+// verifyKey returns the key used to verify the token for its algorithm.
+func (mw *JWTMiddleware) verifyKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if mw.jwks != nil && (strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "ES")) {
+		kid, _ := token.Header["kid"].(string)
+		return mw.jwks.key(kid)
+	}
+	if strings.HasPrefix(alg, "RS") {
+		return mw.PubKey, nil
+	}
+	if strings.HasPrefix(alg, "ES") {
+		return mw.ECPubKey, nil
+	}
+	if mw.KeyForTenant != nil {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" || token.Claims[mw.TenantClaim] != kid {
+			return nil, ErrUnknownKID
+		}
+		key, err := mw.KeyForTenant(kid)
+		if err == nil {
+			err = mw.checkTenantKeyLength(kid, key, alg)
+		}
+		if err != nil {
+			mw.Logger.Printf("jwt: KeyForTenant failed for %s: %v", kid, err)
+			return nil, ErrKeyUnavailable
+		}
+		return key, nil
+	}
+	if len(mw.Keys) != 0 {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := mw.Keys[kid]
+		if !ok {
+			return nil, ErrUnknownKID
+		}
+		return key, nil
+	}
+	return mw.Key, nil
+}
+
+// tokenLookup is a location of TokenLookup.
+type tokenLookup struct {
+	source string
+	name   string
+}
+
+// tokenLookups splits TokenLookup into its locations, in order of precedence.
+func (mw *JWTMiddleware) tokenLookups() []tokenLookup {
+	if mw.TokenLookup == "" {
+		return []tokenLookup{{"header", "Authorization"}}
+	}
+	lookups := []tokenLookup{}
+	for _, location := range strings.Split(mw.TokenLookup, ",") {
+		parts := strings.SplitN(strings.TrimSpace(location), ":", 2)
+		if len(parts) != 2 {
+			lookups = append(lookups, tokenLookup{parts[0], ""})
+		} else {
+			lookups = append(lookups, tokenLookup{parts[0], parts[1]})
+		}
+	}
+	return lookups
+}
+
+// looksUp reports whether TokenLookup reads the token from the named location of source.
+func (mw *JWTMiddleware) looksUp(source string, name string) bool {
+	for _, lookup := range mw.tokenLookups() {
+		if lookup.source == source && lookup.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenCookieName returns the name of the first cookie of TokenLookup, or "" if the token isn't
+// read from a cookie.
+func (mw *JWTMiddleware) tokenCookieName() string {
+	for _, lookup := range mw.tokenLookups() {
+		if lookup.source == "cookie" {
+			return lookup.name
+		}
+	}
+	return ""
+}
+
+// jwtFromHeader reads the token from the header, after the TokenHeadName scheme, which is
+// matched case-insensitively and may be separated from the token by any whitespace (RFC 7235).
+func (mw *JWTMiddleware) jwtFromHeader(request *rest.Request, name string) (string, error) {
+	authHeader := strings.TrimSpace(request.Header.Get(name))
+
+	if authHeader == "" {
+		return "", ErrNoAuthHeader
+	}
+
+	if mw.NoTokenHeadName {
+		return authHeader, nil
+	}
+
+	// tokens never contain whitespace
+	parts := strings.Fields(authHeader)
+	if !(len(parts) == 2 && strings.EqualFold(parts[0], mw.TokenHeadName)) {
+		return "", ErrInvalidAuthHeader
+	}
+
+	return parts[1], nil
+}
+
+func jwtFromCookie(request *rest.Request, name string) (string, error) {
+	cookie, err := request.Cookie(name)
+
+	if err != nil || cookie.Value == "" {
+		return "", ErrNoAuthCookie
+	}
+
+	return strings.TrimPrefix(cookie.Value, "Bearer "), nil
+}
+
+func jwtFromQuery(request *rest.Request, name string) (string, error) {
+	token := request.URL.Query().Get(name)
+
+	if token == "" {
+		return "", ErrNoAuthQueryParam
+	}
+
+	return token, nil
+}
+
+// webSocketProtocols returns the subprotocols offered by the Sec-WebSocket-Protocol headers.
+func webSocketProtocols(request *rest.Request) []string {
+	protocols := []string{}
+	for _, header := range request.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, protocol := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	return protocols
+}
+
+func jwtFromProtocol(request *rest.Request, prefix string) (string, error) {
+	protocols := webSocketProtocols(request)
+	for i := 0; i < len(protocols)-1; i++ {
+		if protocols[i] == prefix && protocols[i+1] != "" {
+			return protocols[i+1], nil
+		}
+	}
+
+	return "", ErrNoAuthProtocol
+}
+
+// echoProtocol selects the prefix of the "protocol" TokenLookup offered by the WebSocket
+// handshake as its subprotocol, browsers fail the handshake when none of theirs is selected.
+func (mw *JWTMiddleware) echoProtocol(writer rest.ResponseWriter, request *rest.Request) {
+	for _, lookup := range mw.tokenLookups() {
+		if lookup.source != "protocol" {
+			continue
+		}
+		if _, err := jwtFromProtocol(request, lookup.name); err == nil {
+			writer.Header().Set("Sec-WebSocket-Protocol", lookup.name)
+			return
+		}
+	}
+}
+
+func (mw *JWTMiddleware) parseToken(request *rest.Request, ignoreExpiry bool) (*jwt.Token, error) {
+	var tokenString string
+	var err error
+
+	// the first location holding a token wins, otherwise the error of the first location is kept
+	for _, lookup := range mw.tokenLookups() {
+		var lookupToken string
+		var lookupErr error
+
+		switch lookup.source {
+		case "header":
+			lookupToken, lookupErr = mw.jwtFromHeader(request, lookup.name)
+		case "cookie":
+			lookupToken, lookupErr = jwtFromCookie(request, lookup.name)
+		case "query":
+			lookupToken, lookupErr = jwtFromQuery(request, lookup.name)
+		case "protocol":
+			lookupToken, lookupErr = jwtFromProtocol(request, lookup.name)
+		default:
+			lookupErr = ErrInvalidTokenLookup
+		}
+
+		if lookupErr == nil {
+			tokenString, err = lookupToken, nil
+			break
+		}
+		if err == nil {
+			err = lookupErr
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := mw.parseTokenString(tokenString, ignoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mw.checkFingerprint(token.Claims, request); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// parseTokenString validates an access token, introspecting it when it's opaque.
+func (mw *JWTMiddleware) parseTokenString(tokenString string, ignoreExpiry bool) (*jwt.Token, error) {
+	if len(tokenString) > mw.MaxTokenLength {
+		return nil, ErrTokenTooLong
+	}
+
+	if mw.introspector != nil && isOpaqueToken(tokenString) {
+		claims, err := mw.introspector.introspect(tokenString, mw.TimeFunc())
+		if err != nil {
+			return nil, err
+		}
+		// the endpoint vouches for the token, the claims are checked like the ones of JWTs
+		if err := mw.checkRegisteredClaims(claims); err != nil {
+			return nil, err
+		}
+		return &jwt.Token{Claims: claims, Valid: true}, nil
+	}
+
+	token, err := mw.validateToken(tokenString, ignoreExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Claims["token_type"] == "refresh" {
+		return nil, ErrInvalidTokenType
+	}
+
+	if mw.TokenStore != nil {
+		if jti, ok := token.Claims["jti"].(string); !ok || !mw.TokenStore.Exists(jti) || !mw.sessionStored(token.Claims) {
+			return nil, ErrRevokedToken
+		}
+	}
+
+	return token, nil
+}
+
+// checkClaims enforces the RequiredClaims and the ClaimsValidator.
+func (mw *JWTMiddleware) checkClaims(claims map[string]interface{}, request *rest.Request) error {
+	for _, claim := range mw.RequiredClaims {
+		if _, ok := claims[claim]; !ok {
+			return ErrMissingClaim
+		}
+	}
+
+	if mw.ClaimsValidator != nil {
+		return mw.ClaimsValidator(claims, request)
+	}
+	return nil
+}
+
+// fingerprint returns the hash of the FingerprintFunc of the request, or "" without one.
+func (mw *JWTMiddleware) fingerprint(request *rest.Request) string {
+	if mw.FingerprintFunc == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(mw.FingerprintFunc(request)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// checkFingerprint rejects tokens whose fgp claim isn't the fingerprint of the request.
+func (mw *JWTMiddleware) checkFingerprint(claims map[string]interface{}, request *rest.Request) error {
+	expected, ok := claims["fgp"].(string)
+	if !ok || mw.FingerprintFunc == nil {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(mw.fingerprint(request))) != 1 {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
+
+// validateToken parses and verifies the token. With ignoreExpiry, the exp claim isn't checked,
+// to refresh expired tokens.
+func (mw *JWTMiddleware) validateToken(tokenString string, ignoreExpiry bool) (*jwt.Token, error) {
+	tokenString, err := mw.decryptToken(tokenString)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// unsigned tokens are never accepted, whatever the configuration
+		if token.Method == jwt.SigningMethodNone || !mw.acceptsAlgorithm(token.Method.Alg()) {
+			return nil, ErrInvalidSigningAlgorithm
+		}
+		if mw.KeyFunc != nil {
+			key, err := mw.KeyFunc(token)
+			if err != nil {
+				mw.Logger.Printf("jwt: KeyFunc failed: %v", err)
+				return nil, ErrKeyUnavailable
+			}
+			return key, nil
+		}
+		return mw.verifyKey(token)
+	})
+
+	// the time based claims are validated against TimeFunc below instead of the jwt clock
+	if err != nil && !onlyTimeValidationFailed(err) {
+		return nil, validationError(err)
+	}
+
+	if err := mw.validateTimes(token, ignoreExpiry); err != nil {
+		return nil, err
+	}
+
+	if err := mw.checkRegisteredClaims(token.Claims); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// checkRegisteredClaims checks the issuer, audience and revocation of a token, whether it's a
+// verified JWT or an introspected opaque token.
+func (mw *JWTMiddleware) checkRegisteredClaims(claims map[string]interface{}) error {
+	if mw.Issuer != "" && claims["iss"] != mw.Issuer {
+		return ErrInvalidIssuer
+	}
+
+	if mw.Audience != "" && !hasAudience(claims["aud"], mw.Audience) {
+		return ErrInvalidAudience
+	}
+
+	if jti, ok := claims["jti"].(string); ok && mw.RevocationStore != nil && mw.RevocationStore.IsRevoked(jti) {
+		return ErrRevokedToken
+	}
+
+	if mw.issuedBeforeCutoff(claims) {
+		return ErrRevokedToken
+	}
+
+	return mw.checkTokenVersion(claims)
+}
+
+// issuedBeforeCutoff reports whether the session of the token started before NotBefore or the
+// MinIssuedAt of its user. Tokens without an OrigIatKey or iat claim are rejected once a cutoff
+// applies.
+func (mw *JWTMiddleware) issuedBeforeCutoff(claims map[string]interface{}) bool {
+	cutoff := mw.NotBefore
+	if mw.MinIssuedAt != nil {
+		if userId, ok := claims[mw.IdentityKey].(string); ok {
+			if userCutoff := mw.MinIssuedAt(userId); userCutoff.After(cutoff) {
+				cutoff = userCutoff
+			}
+		}
+	}
+	if cutoff.IsZero() {
+		return false
+	}
+
+	issuedAt, ok := numericClaim(claims, mw.OrigIatKey)
+	if !ok {
+		issuedAt, ok = numericClaim(claims, "iat")
+	}
+	return !ok || issuedAt < cutoff.Unix()
+}
+
+// onlyTimeValidationFailed reports whether the jwt parser rejected an otherwise valid token
+// because of its exp or nbf claims only.
+func onlyTimeValidationFailed(err error) bool {
+	ve, ok := err.(*jwt.ValidationError)
+	return ok && ve.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) == 0
+}
+
+// validateTimes checks the exp, nbf and, with VerifyIssuedAt, iat claims of the token against
+// TimeFunc, tolerating Leeway.
+func (mw *JWTMiddleware) validateTimes(token *jwt.Token, ignoreExpiry bool) error {
+	now := mw.TimeFunc()
+	for _, name := range []string{"exp", "nbf"} {
+		// rather than silently ignoring them, like the jwt parser does
+		if _, ok := numericClaim(token.Claims, name); !ok && token.Claims[name] != nil {
+			return ErrInvalidToken
+		}
+	}
+	if exp, ok := numericClaim(token.Claims, "exp"); ok && !ignoreExpiry && now.Add(-mw.Leeway).Unix() > exp {
+		return ErrExpiredToken
+	}
+	if nbf, ok := numericClaim(token.Claims, "nbf"); ok && now.Add(mw.Leeway).Unix() < nbf {
+		return ErrTokenNotValidYet
+	}
+	if iat, ok := numericClaim(token.Claims, "iat"); ok && mw.VerifyIssuedAt && now.Add(mw.Leeway).Unix() < iat {
+		return ErrTokenNotValidYet
+	}
+
+	token.Valid = true
+	return nil
+}
+
+// newJTI returns a random version 4 UUID, the default jti of issued tokens.
+func newJTI() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// hasAudience reports whether the aud claim, which is either a string or an array of strings,
+// contains audience.
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericClaim returns the value of a numeric claim as decoded by the jwt parser. Values encoded
+// as strings, e.g. {"exp": "1462361400"} as sent by some issuers, are accepted too.
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	switch value := claims[name].(type) {
+	case float64:
+		return int64(value), true
+	case json.Number:
+		n, err := value.Int64()
+		return n, err == nil
+	case string:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n, true
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		return int64(f), err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+// validationError maps the errors of the jwt parser to the exported errors of this package.
+func validationError(err error) error {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return ErrInvalidToken
+	}
+	if ve.Inner == ErrInvalidSigningAlgorithm || ve.Inner == ErrUnknownKID || ve.Inner == ErrKeyUnavailable {
+		return ve.Inner
+	}
+	return ErrInvalidToken
+}
 
 type token struct {
 	Token string `json:"token"`
 }
 
-// Handler that clients can use to refresh their token. The token still needs to be valid on refresh.
-// Shall be put under an endpoint that is using the JWTMiddleware.
-// Reply will be of the form {"token": "TOKEN"}.
+// Handler that API gateways and other services can use to validate tokens out of band. The token
+// is read from a json payload of the form {"token": "TOKEN"} or, without payload, as configured
+// by TokenLookup. It goes through the same validation as in the middleware, except for the
+// authorization and, for tokens sent in the payload, the FingerprintFunc, whose client isn't
+// known. A one-time token is consumed, so that it's only valid once. Reply will be of the form
+// {"valid": true, "claims": {...}}, or a 401 when the token is invalid.
+func (mw *JWTMiddleware) ValidateHandler(writer rest.ResponseWriter, request *rest.Request) {
+	var claims map[string]interface{}
+
+	payload := token{}
+	err := request.DecodeJsonPayload(&payload)
+	switch {
+	case err == nil && payload.Token != "":
+		var parsed *jwt.Token
+		if parsed, err = mw.parseTokenString(payload.Token, false); err == nil {
+			claims = parsed.Claims
+			if _, ok := claims[mw.IdentityKey].(string); !ok {
+				err = ErrInvalidIdentity
+			}
+		}
+	case err == rest.ErrJsonPayloadEmpty:
+		claims, err = mw.ParseRequest(request)
+	default:
+		err = ErrInvalidLoginPayload
+	}
+
+	if err == nil {
+		err = mw.checkClaims(claims, request)
+	}
+	if err == nil {
+		err = mw.consumeRequestOneTime(request, claims)
+	}
+
+	if err != nil {
+		mw.unauthorized(writer, request, err)
+		return
+	}
+
+	mw.writeJson(writer, http.StatusOK, map[string]interface{}{"valid": true, "claims": claims})
+}
+
+// Handler that clients can use to refresh their token. The token may have expired, as long as it
+// was issued less than MaxRefresh ago, its signature and other claims are still verified.
+// Expired tokens are rejected by the JWTMiddleware itself, so to refresh them the endpoint must
+// not be put under it, see rest.IfMiddleware.
+// Reply will be of the form {"token": "TOKEN", "expire": "2006-01-02T15:04:05Z07:00"}.
 func (mw *JWTMiddleware) RefreshHandler(writer rest.ResponseWriter, request *rest.Request) {
-	token, err := parseToken(request, mw.Key)
+	id, tokenString, expire, err := mw.refresh(writer, request)
+	mw.audit(AuditRefresh, id, request, err)
 
-	// Token should be valid anyway as the RefreshHandler is authed
 	if err != nil {
-		mw.unauthorized(writer)
+		mw.unauthorized(writer, request, err)
 		return
 	}
 
-	origIat := int64(token.Claims["orig_iat"].(float64))
+	if mw.OnTokenRefresh != nil {
+		mw.OnTokenRefresh(id, request)
+	}
+	mw.Metrics.IncRefresh()
+
+	mw.loginResponse(writer, http.StatusOK, tokenString, expire, "", nil)
+}
+
+// refresh reissues the token of the request for RefreshHandler, returning its identity, if
+// known, with the new token. The Retry-After header of a rejected early refresh is set on writer.
+func (mw *JWTMiddleware) refresh(writer rest.ResponseWriter, request *rest.Request) (string, string, time.Time, error) {
+	token, err := mw.parseToken(request, true)
+
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+
+	id, ok := token.Claims[mw.IdentityKey].(string)
+	if !ok {
+		return "", "", time.Time{}, ErrInvalidIdentity
+	}
+
+	origIat, ok := numericClaim(token.Claims, mw.OrigIatKey)
+	if !ok {
+		return id, "", time.Time{}, ErrInvalidOrigIat
+	}
+
+	if origIat < mw.TimeFunc().Add(-mw.MaxRefresh-mw.RefreshGracePeriod).Unix() {
+		return id, "", time.Time{}, ErrExpiredRefresh
+	}
+
+	if err := mw.checkSession(token.Claims); err != nil {
+		return id, "", time.Time{}, err
+	}
+
+	if wait := mw.refreshWait(token.Claims); wait > 0 {
+		setRetryAfter(writer, wait)
+		return id, "", time.Time{}, ErrRefreshTooSoon
+	}
+
+	tokenString, expire, err := mw.createToken(id, mw.sessionOf(token.Claims))
+
+	if err != nil {
+		mw.Logger.Printf("jwt: can't create token: %v", err)
+		return id, "", time.Time{}, ErrFailedTokenCreation
+	}
+
+	// the refreshed token is replaced by the new one
+	if jti, ok := token.Claims["jti"].(string); ok && mw.TokenStore != nil {
+		if err := mw.TokenStore.Delete(jti); err != nil {
+			mw.Logger.Printf("jwt: can't delete token: %v", err)
+		}
+	}
+
+	return id, tokenString, expire, nil
+}
+
+type refreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Handler that clients can use to get a new access token with the refresh token issued by
+// LoginHandler, see RefreshTokenTimeout. Unlike RefreshHandler, the access token may already
+// be expired, so this handler must not be put under an endpoint that is using the JWTMiddleware.
+// Payload needs to be json in the form of {"refresh_token": "REFRESH_TOKEN"}.
+// Reply will be of the form {"token": "TOKEN", "expire": "2006-01-02T15:04:05Z07:00"}. When
+// RefreshTokenStore is set, the presented refresh token is consumed and the reply additionally
+// carries its replacement in the refresh_token field.
+func (mw *JWTMiddleware) RefreshTokenHandler(writer rest.ResponseWriter, request *rest.Request) {
+	id, tokenString, expire, refreshTokenString, err := mw.refreshWithToken(writer, request)
+	mw.audit(AuditRefresh, id, request, err)
 
-	if origIat < time.Now().Add(-mw.MaxRefresh).Unix() {
-		mw.unauthorized(writer)
+	if err != nil {
+		mw.unauthorized(writer, request, err)
 		return
 	}
 
-	newToken := jwt.New(jwt.GetSigningMethod(mw.SigningAlgorithm))
-	newToken.Claims["id"] = token.Claims["id"]
-	newToken.Claims["exp"] = time.Now().Add(mw.Timeout).Unix()
-	newToken.Claims["orig_iat"] = origIat
-	tokenString, err := newToken.SignedString(mw.Key)
+	if mw.OnTokenRefresh != nil {
+		mw.OnTokenRefresh(id, request)
+	}
+	mw.Metrics.IncRefresh()
+
+	mw.loginResponse(writer, http.StatusOK, tokenString, expire, refreshTokenString, nil)
+}
+
+// refreshWait returns how long the token must still wait before being refreshed, see
+// MinRefreshInterval, 0 or less when it can be refreshed right away.
+func (mw *JWTMiddleware) refreshWait(claims map[string]interface{}) time.Duration {
+	if mw.MinRefreshInterval == 0 {
+		return 0
+	}
+	iat, ok := numericClaim(claims, "iat")
+	if !ok {
+		return 0
+	}
+	return time.Unix(iat, 0).Add(mw.MinRefreshInterval).Sub(mw.TimeFunc())
+}
+
+// setRetryAfter sets the Retry-After header to wait, rounded up to the second.
+func setRetryAfter(writer rest.ResponseWriter, wait time.Duration) {
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+// refreshWithToken issues a new access token for the refresh token of RefreshTokenHandler,
+// returning its identity, if known, with the new access token and the replacement refresh token,
+// if any. The Retry-After header of a rejected early refresh is set on writer.
+func (mw *JWTMiddleware) refreshWithToken(writer rest.ResponseWriter, request *rest.Request) (string, string, time.Time, string, error) {
+	payload := refreshTokenPayload{}
+	if err := request.DecodeJsonPayload(&payload); err != nil || payload.RefreshToken == "" {
+		return "", "", time.Time{}, "", ErrInvalidLoginPayload
+	}
+
+	token, err := mw.validateToken(payload.RefreshToken, false)
+
+	if err != nil {
+		return "", "", time.Time{}, "", err
+	}
+
+	if token.Claims["token_type"] != "refresh" {
+		return "", "", time.Time{}, "", ErrInvalidTokenType
+	}
+
+	if err := mw.checkFingerprint(token.Claims, request); err != nil {
+		return "", "", time.Time{}, "", err
+	}
+
+	id, ok := token.Claims[mw.IdentityKey].(string)
+	if !ok {
+		return "", "", time.Time{}, "", ErrInvalidIdentity
+	}
+
+	if err := mw.checkSession(token.Claims); err != nil {
+		return id, "", time.Time{}, "", err
+	}
+	session := mw.sessionOf(token.Claims)
+
+	// before consuming the refresh token, which stays usable once old enough
+	if wait := mw.refreshWait(token.Claims); wait > 0 {
+		setRetryAfter(writer, wait)
+		return id, "", time.Time{}, "", ErrRefreshTooSoon
+	}
+
+	var refreshTokenString string
+	if mw.RefreshTokenStore != nil {
+		jti, _ := token.Claims["jti"].(string)
+		exp, _ := numericClaim(token.Claims, "exp")
+
+		if jti == "" || !mw.RefreshTokenStore.Consume(jti, time.Unix(exp, 0)) {
+			if mw.RefreshReuseDetected != nil {
+				mw.RefreshReuseDetected(id)
+			}
+			return id, "", time.Time{}, "", ErrRefreshTokenReused
+		}
+
+		refreshTokenString, err = mw.createRefreshToken(id, session)
+
+		if err != nil {
+			mw.Logger.Printf("jwt: can't create token: %v", err)
+			return id, "", time.Time{}, "", ErrFailedTokenCreation
+		}
+	}
+
+	tokenString, expire, err := mw.createToken(id, session)
 
 	if err != nil {
-		mw.unauthorized(writer)
+		mw.Logger.Printf("jwt: can't create token: %v", err)
+		return id, "", time.Time{}, "", ErrFailedTokenCreation
+	}
+
+	return id, tokenString, expire, refreshTokenString, nil
+}
+
+// Handler that clients can use to end their session. When the token is read from a cookie, see
+// TokenLookup, the cookie is cleared. With a TokenStore, the presented token and its session are
+// deleted from it, so that neither the token nor the refresh tokens of the session can be used
+// anymore. The session is also revoked in a SessionStore that has a Revoke method, like
+// MemorySessionStore. Otherwise tokens passed in a header can't be invalidated before they
+// expire, so clients must discard them themselves.
+// Reply will be an empty 200.
+func (mw *JWTMiddleware) LogoutHandler(writer rest.ResponseWriter, request *rest.Request) {
+	if mw.TokenStore != nil || mw.SessionStore != nil {
+		if token, err := mw.parseToken(request, true); err == nil {
+			mw.endSession(token.Claims)
+		}
+	}
+
+	if name := mw.tokenCookieName(); name != "" {
+		writer.Header().Add("Set-Cookie", mw.tokenCookie(name, "", -1).String())
+	}
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// sessionRevoker is implemented by the SessionStores that can revoke a single session.
+type sessionRevoker interface {
+	Revoke(sid string)
+}
+
+// endSession deletes the token of the claims, and its session, from the TokenStore and revokes
+// the session in the SessionStore.
+func (mw *JWTMiddleware) endSession(claims map[string]interface{}) {
+	keys := []string{}
+	if jti, ok := claims["jti"].(string); ok {
+		keys = append(keys, jti)
+	}
+	sid, hasSession := claims["sid"].(string)
+	if hasSession {
+		keys = append(keys, sessionKeyPrefix+sid)
+	}
+
+	if mw.TokenStore != nil {
+		for _, key := range keys {
+			if err := mw.TokenStore.Delete(key); err != nil {
+				mw.Logger.Printf("jwt: can't delete token: %v", err)
+			}
+		}
+	}
+	if revoker, ok := mw.SessionStore.(sessionRevoker); ok && hasSession {
+		revoker.Revoke(sid)
+	}
+}
+
+// tokenCookie returns the cookie carrying the token, with the attributes of CookieOptions.
+func (mw *JWTMiddleware) tokenCookie(name string, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     mw.CookieOptions.Path,
+		Domain:   mw.CookieOptions.Domain,
+		MaxAge:   maxAge,
+		Secure:   mw.CookieOptions.Secure,
+		HttpOnly: mw.CookieOptions.HttpOnly,
+		SameSite: mw.CookieOptions.SameSite,
+	}
+}
+
+// setTokenHeaders returns the token in the cookie of TokenLookup and in the TokenResponseHeader,
+// when configured.
+func (mw *JWTMiddleware) setTokenHeaders(writer rest.ResponseWriter, token string, expire time.Time) {
+	if name := mw.tokenCookieName(); name != "" {
+		maxAge := mw.CookieOptions.MaxAge
+		if maxAge == 0 {
+			maxAge = int(expire.Sub(mw.TimeFunc()).Seconds())
+		}
+		writer.Header().Add("Set-Cookie", mw.tokenCookie(name, token, maxAge).String())
+	}
+
+	if mw.TokenResponseHeader != "" {
+		writer.Header().Set(mw.TokenResponseHeader, token)
+	}
+}
+
+func (mw *JWTMiddleware) loginResponse(writer rest.ResponseWriter, code int, token string, expire time.Time, refreshToken string, user map[string]interface{}) {
+	mw.setTokenHeaders(writer, token, expire)
+
+	if mw.LoginResponseFunc != nil {
+		mw.LoginResponseFunc(writer, code, token, expire)
 		return
 	}
 
-	writer.WriteJson(&map[string]string{"token": tokenString})
+	response := map[string]interface{}{"token": token, "expire": expire.Format(time.RFC3339)}
+	if refreshToken != "" {
+		response["refresh_token"] = refreshToken
+	}
+	if user != nil {
+		response["user"] = user
+	}
+
+	if mw.ResponseContentType != "" {
+		writer.Header().Set("Content-Type", mw.ResponseContentType)
+	}
+	if mw.ResponseEnvelope != nil {
+		mw.writeJson(writer, code, mw.ResponseEnvelope(response))
+		return
+	}
+	mw.writeJson(writer, code, &response)
 }
 
-func (mw *JWTMiddleware) unauthorized(writer rest.ResponseWriter) {
-	if mw.NeedPrompt {
-		writer.Header().Set("WWW-Authenticate", "Basic realm="+mw.Realm)
-		rest.Error(writer, "Not Authorized", http.StatusUnauthorized)
-	} else {
-		writer.WriteJson(&map[string]string{"Error": "Not Authorized"})
+// writeJson writes the json response with the status code, logging write failures, e.g. when the
+// client went away.
+func (mw *JWTMiddleware) writeJson(writer rest.ResponseWriter, code int, v interface{}) {
+	writer.WriteHeader(code)
+	if err := writer.WriteJson(v); err != nil {
+		mw.Logger.Printf("jwt: can't write response: %v", err)
 	}
 }
+
+// writeError is rest.Error, without panicking on write failures.
+func (mw *JWTMiddleware) writeError(writer rest.ResponseWriter, message string, code int) {
+	mw.writeJson(writer, code, map[string]string{rest.ErrorFieldName: message})
+}
+
+// realm returns the realm of the request, see RealmFunc.
+func (mw *JWTMiddleware) realm(request *rest.Request) string {
+	if mw.RealmFunc != nil {
+		if realm := mw.RealmFunc(request); realm != "" {
+			return realm
+		}
+	}
+	return mw.Realm
+}
+
+// authenticateHeader returns the RFC 6750 WWW-Authenticate challenge for the rejection reason.
+// Requests without any token, and failed logins, get no error code.
+func (mw *JWTMiddleware) authenticateHeader(request *rest.Request, reason error) string {
+	challenge := "Bearer realm=" + strconv.Quote(mw.realm(request))
+
+	var code string
+	switch reason {
+	case nil, ErrNoAuthHeader, ErrNoAuthCookie, ErrNoAuthQueryParam, ErrNoAuthProtocol, ErrFailedAuthentication, ErrFailedTokenCreation:
+		return challenge
+	case ErrInvalidAuthHeader, ErrInvalidTokenLookup, ErrTokenTooLong:
+		code = "invalid_request"
+	case ErrForbidden:
+		code = "insufficient_scope"
+	default:
+		code = "invalid_token"
+	}
+
+	return challenge + ", error=" + strconv.Quote(code) + ", error_description=" + strconv.Quote(reason.Error())
+}
+
+// HTTPStatusForError returns the status code of the response rejecting a request because of err,
+// one of the errors passed to the Unauthorized callback. The built-in handler answers every
+// rejection with this status, so that custom handlers using it stay consistent with it.
+//
+// A request is answered with a 401 whenever presenting other credentials may succeed: missing
+// tokens, auth headers with another scheme, invalid or expired tokens, failed logins and a
+// denied Authorizator, which has always been a 401. Malformed login payloads, tokens over
+// MaxTokenLength and unknown TokenLookup sources map to 400, ErrTooManyLoginAttempts and
+// ErrRefreshTooSoon to 429, ErrLoginDisabled and ErrAuthenticatorUnavailable to 503 and an
+// *HTTPError to its Code, e.g. a 403 returned by AuthorizatorWithError.
+func HTTPStatusForError(err error) int {
+	if httpError, ok := err.(*HTTPError); ok {
+		return httpError.Code
+	}
+
+	switch err {
+	case ErrInvalidLoginPayload, ErrInvalidTokenLookup, ErrTokenTooLong:
+		// the client sent garbage, retrying with other credentials won't help
+		return http.StatusBadRequest
+	case ErrTooManyLoginAttempts, ErrRefreshTooSoon:
+		return http.StatusTooManyRequests
+	case ErrLoginDisabled, ErrAuthenticatorUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+func (mw *JWTMiddleware) unauthorized(writer rest.ResponseWriter, request *rest.Request, reason error) {
+	if code := HTTPStatusForError(reason); mw.NeedPrompt && (code == http.StatusUnauthorized || code == http.StatusForbidden || (code == http.StatusBadRequest && reason != ErrInvalidLoginPayload)) {
+		writer.Header().Set("WWW-Authenticate", mw.authenticateHeader(request, reason))
+	}
+
+	if mw.Unauthorized != nil {
+		mw.Unauthorized(writer, request, reason)
+		return
+	}
+
+	if httpError, ok := reason.(*HTTPError); ok {
+		mw.writeError(writer, httpError.Message, httpError.Code)
+		return
+	}
+
+	if code := HTTPStatusForError(reason); code != http.StatusUnauthorized {
+		mw.writeError(writer, reason.Error(), code)
+		return
+	}
+
+	response := map[string]string{"Error": "Not Authorized"}
+
+	// lets clients refresh their token silently instead of asking for credentials again
+	if reason == ErrExpiredToken {
+		response["Code"] = "token_expired"
+	}
+
+	mw.writeJson(writer, http.StatusUnauthorized, &response)
+}
@@ -1,15 +1,31 @@
 package jwt
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/ant0ine/go-json-rest/rest/test"
 	"github.com/dgrijalva/jwt-go"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 type DecoderToken struct {
-	Token string `json:"token"`
+	Token  string `json:"token"`
+	Expire string `json:"expire"`
 }
 
 func makeTokenString(username string, key []byte) string {
@@ -22,7 +38,7 @@ func makeTokenString(username string, key []byte) string {
 }
 
 func TestAuthJWT(t *testing.T) {
-	key := []byte("secret key")
+	key := []byte("secret key secret key secret key")
 
 	// the middleware to test
 	authMiddleware := &JWTMiddleware{
@@ -64,15 +80,8 @@ func TestAuthJWT(t *testing.T) {
 	recorded.CodeIs(401)
 	recorded.ContentTypeIsJson()
 
-	// wrong Auth format - bearer lower case
-	wrongAuthFormat := test.MakeSimpleRequest("GET", "http://localhost/", nil)
-	wrongAuthFormat.Header.Set("Authorization", "bearer "+makeTokenString("admin", key))
-	recorded = test.RunRequest(t, handler, wrongAuthFormat)
-	recorded.CodeIs(401)
-	recorded.ContentTypeIsJson()
-
 	// wrong Auth format - no space after bearer
-	wrongAuthFormat = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	wrongAuthFormat := test.MakeSimpleRequest("GET", "http://localhost/", nil)
 	wrongAuthFormat.Header.Set("Authorization", "bearer"+makeTokenString("admin", key))
 	recorded = test.RunRequest(t, handler, wrongAuthFormat)
 	recorded.CodeIs(401)
@@ -115,6 +124,10 @@ func TestAuthJWT(t *testing.T) {
 		if user != "admin" {
 			t.Error("REMOTE_USER is expected to be 'admin'")
 		}
+		payload, ok := r.Env["JWT_PAYLOAD"].(map[string]interface{})
+		if !ok || payload["id"] != "admin" {
+			t.Error("JWT_PAYLOAD is expected to contain the token claims")
+		}
 		w.WriteJson(map[string]string{"Id": "123"})
 	}))
 
@@ -158,7 +171,7 @@ func TestAuthJWT(t *testing.T) {
 	})
 
 	if err != nil {
-		t.Errorf("Received new token with wrong signature", err)
+		t.Errorf("Received new token with wrong signature: %v", err)
 	}
 
 	if newToken.Claims["id"].(string) != "admin" ||
@@ -166,6 +179,11 @@ func TestAuthJWT(t *testing.T) {
 		t.Errorf("Received new token with wrong data")
 	}
 
+	expire, err := time.Parse(time.RFC3339, nToken.Expire)
+	if err != nil || expire.Unix() != int64(newToken.Claims["exp"].(float64)) {
+		t.Errorf("Received new token with wrong expire %v", nToken.Expire)
+	}
+
 	refreshApi := rest.NewApi()
 	refreshApi.Use(authMiddleware)
 	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
@@ -206,7 +224,7 @@ func TestAuthJWT(t *testing.T) {
 	})
 
 	if err != nil {
-		t.Errorf("Received refreshed token with wrong signature", err)
+		t.Errorf("Received refreshed token with wrong signature: %v", err)
 	}
 
 	if refreshToken.Claims["id"].(string) != "admin" ||
@@ -215,3 +233,4946 @@ func TestAuthJWT(t *testing.T) {
 		t.Errorf("Received refreshed token with wrong data")
 	}
 }
+
+func TestAuthJWTRSA(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the issuing middleware holds the private key
+	issuer := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "RS256",
+		PrivKey:          privKey,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	issuer.MiddlewareFunc(nil)
+
+	// the verifying middleware only knows the public key
+	verifier := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "RS256",
+		PubKey:           &privKey.PublicKey,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(issuer.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	api := rest.NewApi()
+	api.Use(verifier)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		if r.Env["REMOTE_USER"].(string) != "admin" {
+			t.Error("REMOTE_USER is expected to be 'admin'")
+		}
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// token signed with the matching private key
+	validReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	validReq.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, validReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// token signed with another private key
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, _ := token.SignedString(otherKey)
+
+	wrongKeyReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	wrongKeyReq.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, handler, wrongKeyReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTECDSA(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "ES256",
+		ECPrivKey:        privKey,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	loginApi := rest.NewApi()
+	loginApi.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+	)
+	loginApi.SetApp(router)
+	handler := loginApi.MakeHandler()
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	validReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	validReq.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, validReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// an HS token can't be verified with the ECDSA public key
+	hsReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	hsReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("secret key secret key secret key")))
+	recorded = test.RunRequest(t, handler, hsReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTAlgorithmMismatch(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "HS256",
+		Key:              key,
+		MaxRefresh:       time.Hour,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+
+	refreshApi := rest.NewApi()
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+
+	// token signed with the right key but declaring another algorithm
+	token := jwt.New(jwt.GetSigningMethod("HS512"))
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["orig_iat"] = time.Now().Unix()
+	tokenString, _ := token.SignedString(key)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the refresh handler applies the same check
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, refreshApi.MakeHandler(), req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTPayload(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    time.Hour,
+		MaxRefresh: time.Hour * 24,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			// exp is reserved and must not be overwritten
+			return map[string]interface{}{"role": "admin-" + userId, "exp": 0}
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	newToken, err := jwt.Parse(nToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if err != nil {
+		t.Fatalf("Received new token with wrong signature: %v", err)
+	}
+
+	if newToken.Claims["role"] != "admin-admin" {
+		t.Errorf("Received new token without the payload claim")
+	}
+
+	refreshReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, refreshHandler, refreshReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	refreshToken, err := jwt.Parse(rToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if err != nil {
+		t.Fatalf("Received refreshed token with wrong signature: %v", err)
+	}
+
+	if refreshToken.Claims["role"] != "admin-admin" {
+		t.Errorf("Received refreshed token without the payload claim")
+	}
+}
+
+func TestAuthJWTIdentityKey(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		IdentityKey: "sub",
+		MaxRefresh:  time.Hour,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		if r.Env["REMOTE_USER"] != "admin" {
+			t.Error("REMOTE_USER is expected to be 'admin'")
+		}
+		authMiddleware.RefreshHandler(w, r)
+	}))
+
+	token := jwt.New(jwt.GetSigningMethod("HS256"))
+	token.Claims["sub"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["orig_iat"] = time.Now().Unix()
+	tokenString, _ := token.SignedString(key)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	refreshToken, err := jwt.Parse(rToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if err != nil {
+		t.Fatalf("Received refreshed token with wrong signature: %v", err)
+	}
+
+	if refreshToken.Claims["sub"] != "admin" {
+		t.Errorf("Received refreshed token without the identity claim")
+	}
+	if _, ok := refreshToken.Claims["id"]; ok {
+		t.Errorf("Received refreshed token with the default identity claim")
+	}
+}
+
+func TestAuthJWTMalformedClaims(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+	handler := api.MakeHandler()
+
+	refreshApi := rest.NewApi()
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	// missing id claim
+	token := jwt.New(jwt.GetSigningMethod("HS256"))
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["orig_iat"] = time.Now().Unix()
+	tokenString, _ := token.SignedString(key)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// id claim stored as a number
+	token.Claims["id"] = 42
+	tokenString, _ = token.SignedString(key)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// refresh without orig_iat claim
+	token.Claims["id"] = "admin"
+	delete(token.Claims, "orig_iat")
+	tokenString, _ = token.SignedString(key)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, refreshHandler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTCookie(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		TokenLookup: "cookie:jwt",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		if r.Env["REMOTE_USER"] != "admin" {
+			t.Error("REMOTE_USER is expected to be 'admin'")
+		}
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// token in the cookie
+	cookieReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	cookieReq.AddCookie(&http.Cookie{Name: "jwt", Value: makeTokenString("admin", key)})
+	recorded := test.RunRequest(t, handler, cookieReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// token in the cookie with a Bearer prefix
+	cookieReq = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	cookieReq.AddCookie(&http.Cookie{Name: "jwt", Value: "Bearer " + makeTokenString("admin", key)})
+	recorded = test.RunRequest(t, handler, cookieReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// the header is not consulted in cookie mode
+	headerReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	headerReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, headerReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// token in a cookie with another name
+	wrongCookieReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	wrongCookieReq.AddCookie(&http.Cookie{Name: "token", Value: makeTokenString("admin", key)})
+	recorded = test.RunRequest(t, handler, wrongCookieReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTQueryParam(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:           "test zone",
+		Key:             key,
+		TokenQueryParam: "access_token",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// token in the query string
+	queryReq := test.MakeSimpleRequest("GET", "http://localhost/?access_token="+makeTokenString("admin", key), nil)
+	recorded := test.RunRequest(t, handler, queryReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// the header is preferred over the query string
+	bothReq := test.MakeSimpleRequest("GET", "http://localhost/?access_token="+makeTokenString("admin", key), nil)
+	bothReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key")))
+	recorded = test.RunRequest(t, handler, bothReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the deprecated field is an alias of a trailing query TokenLookup
+	if authMiddleware.TokenLookup != "header:Authorization,query:access_token" {
+		t.Errorf("expected the query location appended to TokenLookup, got %q", authMiddleware.TokenLookup)
+	}
+
+	// query string tokens are ignored unless enabled
+	authMiddleware = &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	api = rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	queryReq = test.MakeSimpleRequest("GET", "http://localhost/?access_token="+makeTokenString("admin", key), nil)
+	recorded = test.RunRequest(t, api.MakeHandler(), queryReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTTokenHeadName(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	cases := []struct {
+		tokenHeadName   string
+		noTokenHeadName bool
+		header          string
+		code            int
+	}{
+		{"Bearer", false, "Bearer ", 200},
+		{"Bearer", false, "bearer ", 200},
+		{"Bearer", false, "JWT ", 401},
+		{"JWT", false, "JWT ", 200},
+		{"JWT", false, "jwt ", 200},
+		{"JWT", false, "Bearer ", 401},
+		{"Token", false, "Token ", 200},
+		{"Bearer", true, "", 200},
+		{"Bearer", true, "Bearer ", 401},
+	}
+
+	for _, c := range cases {
+		authMiddleware.TokenHeadName = c.tokenHeadName
+		authMiddleware.NoTokenHeadName = c.noTokenHeadName
+
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", c.header+makeTokenString("admin", key))
+		recorded := test.RunRequest(t, handler, req)
+		recorded.CodeIs(c.code)
+		recorded.ContentTypeIsJson()
+	}
+}
+
+func TestAuthJWTUnauthorizedFunc(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	var reason error
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		Unauthorized: func(writer rest.ResponseWriter, request *rest.Request, err error) {
+			reason = err
+			writer.WriteHeader(http.StatusUnauthorized)
+			writer.WriteJson(map[string]string{"code": "unauthorized", "message": err.Error()})
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+
+	recorded := test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	if reason == nil {
+		t.Fatal("Unauthorized is expected to receive the reason")
+	}
+	recorded.BodyIs(`{"code":"unauthorized","message":"` + reason.Error() + `"}`)
+}
+
+func TestAuthJWTErrors(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	var reason error
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		Authorizator: func(userId string, request *rest.Request) bool {
+			return request.Method == "GET"
+		},
+		Unauthorized: func(writer rest.ResponseWriter, request *rest.Request, err error) {
+			reason = err
+			rest.Error(writer, err.Error(), http.StatusUnauthorized)
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+	handler := api.MakeHandler()
+
+	expired := jwt.New(jwt.GetSigningMethod("HS256"))
+	expired.Claims["id"] = "admin"
+	expired.Claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	expiredString, _ := expired.SignedString(key)
+	expiredForgedString, _ := expired.SignedString([]byte("sekret key"))
+
+	otherAlg := jwt.New(jwt.GetSigningMethod("HS384"))
+	otherAlg.Claims["id"] = "admin"
+	otherAlg.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	otherAlgString, _ := otherAlg.SignedString(key)
+
+	noIdentity := jwt.New(jwt.GetSigningMethod("HS256"))
+	noIdentity.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	noIdentityString, _ := noIdentity.SignedString(key)
+
+	cases := []struct {
+		method string
+		header string
+		err    error
+	}{
+		{"GET", "", ErrNoAuthHeader},
+		{"GET", "Basic dXNlcjpwYXNz", ErrInvalidAuthHeader},
+		{"GET", "Bearer " + expiredString, ErrExpiredToken},
+		{"GET", "Bearer " + expiredForgedString, ErrInvalidToken},
+		{"GET", "Bearer " + otherAlgString, ErrInvalidSigningAlgorithm},
+		{"GET", "Bearer garbage", ErrInvalidToken},
+		{"GET", "Bearer " + noIdentityString, ErrInvalidIdentity},
+		{"POST", "Bearer " + makeTokenString("admin", key), ErrForbidden},
+	}
+
+	for _, c := range cases {
+		reason = nil
+		req := test.MakeSimpleRequest(c.method, "http://localhost/", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		recorded := test.RunRequest(t, handler, req)
+		recorded.CodeIs(401)
+
+		if !errors.Is(reason, c.err) {
+			t.Errorf("Expected reason %v, got %v", c.err, reason)
+		}
+	}
+}
+
+func TestAuthJWTLeeway(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:  "test zone",
+		Key:    key,
+		Leeway: 2 * time.Second,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	makeExpiredToken := func(expiredBy time.Duration) string {
+		token := jwt.New(jwt.GetSigningMethod("HS256"))
+		token.Claims["id"] = "admin"
+		token.Claims["exp"] = time.Now().Add(-expiredBy).Unix()
+		tokenString, _ := token.SignedString(key)
+		return tokenString
+	}
+
+	// expired by one second, within the leeway
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeExpiredToken(time.Second))
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// expired by a minute, beyond the leeway
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeExpiredToken(time.Minute))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the leeway doesn't help tokens with an invalid signature
+	token := jwt.New(jwt.GetSigningMethod("HS256"))
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(-time.Second).Unix()
+	tokenString, _ := token.SignedString([]byte("sekret key"))
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// no tolerance by default
+	authMiddleware.Leeway = 0
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeExpiredToken(time.Second))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTIssuer(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:  "test zone",
+		Key:    key,
+		Issuer: "auth.example.com",
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	// token minted with the matching issuer
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// token minted by another issuer
+	token := jwt.New(jwt.GetSigningMethod("HS256"))
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	token.Claims["iss"] = "evil.example.com"
+	tokenString, _ := token.SignedString(key)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// token without issuer
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTAudience(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:    "test zone",
+		Key:      key,
+		Audience: "orders",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	cases := []struct {
+		aud  interface{}
+		code int
+	}{
+		{"orders", 200},
+		{[]string{"billing", "orders"}, 200},
+		{"billing", 401},
+		{[]string{"billing", "shipping"}, 401},
+		{nil, 401},
+	}
+
+	for _, c := range cases {
+		token := jwt.New(jwt.GetSigningMethod("HS256"))
+		token.Claims["id"] = "admin"
+		token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+		if c.aud != nil {
+			token.Claims["aud"] = c.aud
+		}
+		tokenString, _ := token.SignedString(key)
+
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		recorded := test.RunRequest(t, handler, req)
+		recorded.CodeIs(c.code)
+		recorded.ContentTypeIsJson()
+	}
+}
+
+func TestAuthJWTNotBefore(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	nbf := time.Now().Add(time.Hour)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:   "test zone",
+		Key:     key,
+		Timeout: 2 * time.Hour,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"nbf": nbf.Unix()}
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	// used before nbf
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// used after nbf
+	authMiddleware.TimeFunc = func() time.Time {
+		return nbf.Add(time.Minute)
+	}
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	authMiddleware.TimeFunc = time.Now
+
+	// nbf within the leeway
+	authMiddleware.Leeway = time.Second * 2
+	nbf = time.Now().Add(time.Second)
+	recorded = test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTPayloadFuncReservedClaims(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:             "test zone",
+		Key:               []byte("secret key secret key secret key"),
+		Timeout:           time.Hour,
+		OneTimeTokenStore: &MemoryRevocationStore{},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{
+				"token_type": "refresh",
+				"one_time":   true,
+				"id":         "root",
+				"iss":        "evil",
+				"role":       "admin",
+			}
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	token, err := authMiddleware.validateToken(nToken.Token, false)
+	if err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	for _, claim := range []string{"token_type", "one_time", "iss"} {
+		if value, ok := token.Claims[claim]; ok {
+			t.Errorf("expected no %s claim, got %v", claim, value)
+		}
+	}
+	if token.Claims["role"] != "admin" {
+		t.Errorf("expected the role claim, got %v", token.Claims["role"])
+	}
+
+	// usable as an access token, more than once
+	for i := 0; i < 2; i++ {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+nToken.Token)
+		recorded = test.RunRequest(t, handler, req)
+		recorded.CodeIs(200)
+		recorded.BodyIs(`{"Id":"admin"}`)
+	}
+}
+
+func TestAuthJWTTimeFunc(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    48 * time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	refresh := func() *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+nToken.Token)
+		return test.RunRequest(t, refreshHandler, req)
+	}
+
+	// the token was issued long ago according to the real clock, but is fresh for the middleware
+	recorded = refresh()
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// refresh in the last second of MaxRefresh
+	now = issuedAt.Add(24 * time.Hour)
+	recorded = refresh()
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// one second after MaxRefresh
+	now = issuedAt.Add(24*time.Hour + time.Second)
+	recorded = refresh()
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// one second after the token expired
+	now = issuedAt.Add(48*time.Hour + time.Second)
+	authMiddleware.MaxRefresh = 72 * time.Hour
+	recorded = refresh()
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTLogout(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         []byte("secret key secret key secret key"),
+		TokenLookup: "cookie:jwt",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	// initialize the defaults, LogoutHandler is usually not behind the middleware
+	authMiddleware.MiddlewareFunc(nil)
+
+	logoutApi := rest.NewApi()
+	logoutApi.SetApp(rest.AppSimple(authMiddleware.LogoutHandler))
+
+	recorded := test.RunRequest(t, logoutApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Set-Cookie", "jwt=; Path=/; Max-Age=0; HttpOnly; Secure; SameSite=Lax")
+
+	// nothing to clear in header mode
+	authMiddleware.TokenLookup = "header:Authorization"
+	recorded = test.RunRequest(t, logoutApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Set-Cookie", "")
+}
+
+func TestAuthJWTRevocation(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	store := &MemoryRevocationStore{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:           "test zone",
+		Key:             key,
+		RevocationStore: store,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	newToken, _ := jwt.Parse(nToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	jti, ok := newToken.Claims["jti"].(string)
+	if !ok || len(jti) != 36 {
+		t.Fatalf("Received new token without a jti")
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	store.Revoke(jti, time.Now().Add(time.Hour))
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTJTI(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	count := 0
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour,
+		JTIFunc: func() string {
+			count++
+			return fmt.Sprintf("jti-%d", count)
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	newToken, _ := jwt.Parse(nToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if newToken.Claims["jti"] != "jti-1" {
+		t.Errorf("Received new token with wrong jti %v", newToken.Claims["jti"])
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+nToken.Token)
+	recorded = test.RunRequest(t, refreshHandler, req)
+	recorded.CodeIs(200)
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	refreshToken, _ := jwt.Parse(rToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if refreshToken.Claims["jti"] != "jti-2" {
+		t.Errorf("Received refreshed token with wrong jti %v", refreshToken.Claims["jti"])
+	}
+	if refreshToken.Claims["orig_iat"] != newToken.Claims["orig_iat"] {
+		t.Errorf("Received refreshed token with wrong orig_iat")
+	}
+}
+
+func TestAuthJWTAuthenticatorWithRequest(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		AuthenticatorWithRequest: func(userId string, password string, request *rest.Request) bool {
+			return userId == "admin" && password == "admin" && request.Header.Get("X-Device") == "trusted"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+
+	req := test.MakeSimpleRequest("POST", "http://localhost/", loginCreds)
+	req.Header.Set("X-Device", "trusted")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	req = test.MakeSimpleRequest("POST", "http://localhost/", loginCreds)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTLoginPayloadFunc(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		LoginPayloadFunc: func(request *rest.Request) (string, bool) {
+			payload := struct {
+				Email string `json:"email"`
+				OTP   string `json:"otp"`
+			}{}
+			if err := request.DecodeJsonPayload(&payload); err != nil {
+				return "", false
+			}
+			return payload.Email, payload.Email == "admin@example.com" && payload.OTP == "123456"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	loginCreds := map[string]string{"email": "admin@example.com", "otp": "123456"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	newToken, _ := jwt.Parse(nToken.Token, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+
+	if newToken.Claims["id"] != "admin@example.com" {
+		t.Errorf("Received new token with wrong identity %v", newToken.Claims["id"])
+	}
+
+	wrongCreds := map[string]string{"email": "admin@example.com", "otp": "654321"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", wrongCreds))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTLoginResponseFunc(t *testing.T) {
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		Timeout:    time.Hour,
+		MaxRefresh: time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		LoginResponseFunc: func(writer rest.ResponseWriter, code int, token string, expire time.Time) {
+			writer.WriteHeader(code)
+			writer.WriteJson(map[string]interface{}{
+				"access_token": token,
+				"expires_in":   int(expire.Sub(now).Seconds()),
+			})
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	response := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+
+	if response.AccessToken == "" || response.ExpiresIn != 3600 {
+		t.Errorf("Received unexpected login response %+v", response)
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	recorded = test.RunRequest(t, refreshHandler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	response.AccessToken = ""
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+
+	if response.AccessToken == "" || response.ExpiresIn != 3600 {
+		t.Errorf("Received unexpected refresh response %+v", response)
+	}
+}
+
+func TestAuthJWTAuthorizatorWithError(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		AuthorizatorWithError: func(userId string, request *rest.Request) error {
+			if request.Method != "GET" {
+				return &HTTPError{Code: http.StatusForbidden, Message: "Read only access"}
+			}
+			return nil
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// unauthenticated
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// authenticated and authorized
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// authenticated but not authorized
+	req = test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(403)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Read only access"}`)
+}
+
+func TestAuthJWTRefreshToken(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 key,
+		Timeout:             time.Minute,
+		RefreshTokenTimeout: 30 * 24 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path == "/"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	loginResponse := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	test.DecodeJsonPayload(recorded.Recorder, &loginResponse)
+
+	if loginResponse.RefreshToken == "" {
+		t.Fatal("Received login response without refresh token")
+	}
+
+	// the refresh token isn't accepted as access token
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+loginResponse.RefreshToken)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the access token isn't accepted as refresh token
+	refreshPayload := map[string]string{"refresh_token": loginResponse.Token}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the access token has expired, the refresh token is still valid
+	now = issuedAt.Add(time.Hour)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+loginResponse.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	refreshPayload = map[string]string{"refresh_token": loginResponse.RefreshToken}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+rToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// the refresh token has expired as well
+	now = issuedAt.Add(31 * 24 * time.Hour)
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTRefreshTokenRotation(t *testing.T) {
+	var reusedBy string
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		RefreshTokenTimeout: 24 * time.Hour,
+		RefreshTokenStore:   &MemoryRevocationStore{},
+		RefreshReuseDetected: func(userId string) {
+			reusedBy = userId
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	response := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+	firstRefreshToken := response.RefreshToken
+
+	// the first use rotates the refresh token
+	refreshPayload := map[string]string{"refresh_token": firstRefreshToken}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+
+	if response.RefreshToken == "" || response.RefreshToken == firstRefreshToken {
+		t.Fatal("Received refresh response without a new refresh token")
+	}
+
+	// the consumed refresh token can't be used again
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	if reusedBy != "admin" {
+		t.Errorf("RefreshReuseDetected is expected to be called for 'admin'")
+	}
+
+	// the new refresh token is valid
+	refreshPayload = map[string]string{"refresh_token": response.RefreshToken}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", refreshPayload))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTKeyRotation(t *testing.T) {
+	oldKey := []byte("old secret key old secret key old")
+	newKey := []byte("new secret key new secret key new")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:     "test zone",
+		Keys:      map[string][]byte{"2015-01": oldKey},
+		ActiveKID: "2015-01",
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	loginHandler := loginApi.MakeHandler()
+
+	login := func() string {
+		loginCreds := map[string]string{"username": "admin", "password": "admin"}
+		recorded := test.RunRequest(t, loginHandler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+		recorded.CodeIs(200)
+		nToken := DecoderToken{}
+		test.DecodeJsonPayload(recorded.Recorder, &nToken)
+		return nToken.Token
+	}
+
+	get := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	oldToken := login()
+	parsed, _ := jwt.Parse(oldToken, func(token *jwt.Token) (interface{}, error) {
+		return oldKey, nil
+	})
+	if !parsed.Valid || parsed.Header["kid"] != "2015-01" {
+		t.Fatal("Received new token not signed with the active key")
+	}
+
+	// rotate the active key
+	authMiddleware.Keys["2015-02"] = newKey
+	authMiddleware.ActiveKID = "2015-02"
+
+	newToken := login()
+	parsed, _ = jwt.Parse(newToken, func(token *jwt.Token) (interface{}, error) {
+		return newKey, nil
+	})
+	if !parsed.Valid || parsed.Header["kid"] != "2015-02" {
+		t.Fatal("Received new token not signed with the rotated key")
+	}
+
+	get(oldToken).CodeIs(200)
+	get(newToken).CodeIs(200)
+
+	// the old key is retired
+	delete(authMiddleware.Keys, "2015-01")
+	get(oldToken).CodeIs(401)
+	get(newToken).CodeIs(200)
+
+	// tokens without kid are rejected
+	get(makeTokenString("admin", newKey)).CodeIs(401)
+}
+
+func TestAuthJWTKeyFiles(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	privKeyFile := filepath.Join(dir, "jwt.key")
+	pubKeyFile := filepath.Join(dir, "jwt.pub")
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privKey)})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	if err := ioutil.WriteFile(privKeyFile, privPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pubKeyFile, pubPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "RS256",
+		PrivKeyFile:      privKeyFile,
+		PubKeyFile:       pubKeyFile,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	if authMiddleware.PrivKey == nil || authMiddleware.PrivKey.D.Cmp(privKey.D) != 0 {
+		t.Error("PrivKey is expected to be read from PrivKeyFile")
+	}
+	if authMiddleware.PubKey == nil || authMiddleware.PubKey.N.Cmp(privKey.N) != 0 {
+		t.Error("PubKey is expected to be read from PubKeyFile")
+	}
+}
+
+func TestAuthJWTPrivKeyFileOnly(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	rsaKeyFile := filepath.Join(dir, "rsa.key")
+	ecKeyFile := filepath.Join(dir, "ec.key")
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes})
+	if err := ioutil.WriteFile(rsaKeyFile, rsaPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ecKeyFile, ecPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for keyFile, algorithm := range map[string]string{rsaKeyFile: "RS256", ecKeyFile: "ES384"} {
+		authMiddleware, err := New(JWTMiddleware{
+			Realm:       "test zone",
+			PrivKeyFile: keyFile,
+			Authenticator: func(userId string, password string) bool {
+				return false
+			},
+		})
+		if err != nil {
+			t.Fatalf("New is expected to accept %s alone, got %v", keyFile, err)
+		}
+		if authMiddleware.SigningAlgorithm != algorithm {
+			t.Errorf("SigningAlgorithm is expected to be %s, got %s", algorithm, authMiddleware.SigningAlgorithm)
+		}
+
+		tokenString, _, err := authMiddleware.GenerateToken("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authMiddleware.parseTokenString(tokenString, false); err != nil {
+			t.Errorf("tokens signed with %s are expected to verify, got %v", algorithm, err)
+		}
+	}
+}
+
+func TestAuthJWTGenerateToken(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"role": "admin"}
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		if r.Env["REMOTE_USER"] != "admin" {
+			t.Error("REMOTE_USER is expected to be 'admin'")
+		}
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	tokenString, expire, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	if token.Claims["role"] != "admin" || token.Claims["orig_iat"] == nil ||
+		int64(token.Claims["exp"].(float64)) != expire.Unix() {
+		t.Errorf("Generated token with wrong data")
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTParseRequest(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		TokenLookup: "cookie:jwt",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		claims, err := authMiddleware.ParseRequest(r)
+		if err != nil {
+			rest.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteJson(map[string]interface{}{"id": claims["id"]})
+	}))
+	handler := api.MakeHandler()
+
+	// valid token in the configured cookie
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: makeTokenString("admin", key)})
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"id":"admin"}`)
+
+	// the header isn't consulted
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Error":"` + ErrNoAuthCookie.Error() + `"}`)
+
+	// invalid signature
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: makeTokenString("admin", []byte("sekret key"))})
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Error":"` + ErrInvalidToken.Error() + `"}`)
+}
+
+func TestAuthJWTNoneAlgorithm(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+	handler := api.MakeHandler()
+
+	token := jwt.New(jwt.SigningMethodNone)
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// same token with its signature stripped
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSuffix(tokenString, "."))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTAllowWeakKey(t *testing.T) {
+	key := []byte("weak")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:        "test zone",
+		Key:          key,
+		AllowWeakKey: true,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTKeyString(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:     "test zone",
+		KeyString: "secret key secret key secret key",
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("secret key secret key secret key")))
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	wrongKeyReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	wrongKeyReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	recorded = test.RunRequest(t, handler, wrongKeyReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTEventHooks(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	events := []string{}
+	record := func(event string) func(userId string, request *rest.Request) {
+		return func(userId string, request *rest.Request) {
+			events = append(events, event+" "+userId)
+		}
+	}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour * 24,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		Authorizator: func(userId string, request *rest.Request) bool {
+			return request.Method == "GET"
+		},
+		OnLoginSuccess:        record("login success"),
+		OnLoginFailure:        record("login failure"),
+		OnAuthorizationDenied: record("authorization denied"),
+		OnTokenRefresh:        record("token refresh"),
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Post("/", func(w rest.ResponseWriter, r *rest.Request) {
+			t.Error("Should never be executed")
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	wrongCreds := map[string]string{"username": "admin", "password": "wrong"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", wrongCreds))
+	recorded.CodeIs(401)
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+
+	refreshReq := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, refreshReq)
+	recorded.CodeIs(200)
+
+	deniedReq := test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	deniedReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, deniedReq)
+	recorded.CodeIs(401)
+
+	expected := []string{"login failure admin", "login success admin", "token refresh admin", "authorization denied admin"}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestAuthJWTExpiresIn(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:   "test zone",
+		Key:     key,
+		Timeout: time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	var expiresIn time.Duration
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		expiresIn = r.Env["JWT_EXPIRES_IN"].(time.Duration)
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = issuedAt.Add(15 * time.Minute)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	if expiresIn != 45*time.Minute {
+		t.Errorf("Expected JWT_EXPIRES_IN of 45m, got %v", expiresIn)
+	}
+}
+
+func TestAuthJWTCookieOptions(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Now()
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		Timeout:     time.Hour,
+		MaxRefresh:  time.Hour * 24,
+		TokenLookup: "cookie:jwt",
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// defaults
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	recorded.HeaderIs("Set-Cookie", "jwt="+nToken.Token+"; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax")
+
+	// custom attributes
+	authMiddleware.CookieOptions = &CookieOptions{
+		Path:     "/api",
+		Domain:   "example.com",
+		MaxAge:   600,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: nToken.Token})
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	recorded.HeaderIs("Set-Cookie", "jwt="+rToken.Token+"; Path=/api; Domain=example.com; Max-Age=600; SameSite=Strict")
+}
+
+func TestAuthJWTCookieOptionsDefaults(t *testing.T) {
+	options := &CookieOptions{Domain: "example.com"}
+	authMiddleware, err := New(JWTMiddleware{
+		Realm:         "test zone",
+		Key:           []byte("secret key secret key secret key"),
+		TokenLookup:   "cookie:jwt",
+		CookieOptions: options,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a partial CookieOptions keeps the defaults of the other attributes
+	cookie := authMiddleware.tokenCookie("jwt", "token", 60).String()
+	if cookie != "jwt=token; Path=/; Domain=example.com; Max-Age=60; HttpOnly; Secure; SameSite=Lax" {
+		t.Errorf("unexpected cookie %s", cookie)
+	}
+	if *options != (CookieOptions{Domain: "example.com"}) {
+		t.Errorf("expected the given CookieOptions to be left unchanged, got %+v", *options)
+	}
+
+	// the secure defaults can be opted out of explicitly
+	authMiddleware, err = New(JWTMiddleware{
+		Realm:         "test zone",
+		Key:           []byte("secret key secret key secret key"),
+		TokenLookup:   "cookie:jwt",
+		CookieOptions: &CookieOptions{AllowInsecure: true, AllowScriptAccess: true},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie = authMiddleware.tokenCookie("jwt", "token", 60).String()
+	if cookie != "jwt=token; Path=/; Max-Age=60; SameSite=Lax" {
+		t.Errorf("unexpected cookie %s", cookie)
+	}
+
+	if _, err := New(JWTMiddleware{
+		Realm:         "test zone",
+		Key:           []byte("secret key secret key secret key"),
+		TokenLookup:   "cookie:jwt",
+		CookieOptions: &CookieOptions{AllowInsecure: true, SameSite: http.SameSiteNoneMode},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}); err == nil {
+		t.Errorf("expected SameSite=None to require Secure")
+	}
+}
+
+func TestAuthJWTCookieSameSiteNone(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         []byte("secret key secret key secret key"),
+		TokenLookup: "cookie:jwt",
+		CookieOptions: &CookieOptions{
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+	)
+	api.SetApp(router)
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	cookie := recorded.Recorder.Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, "; Secure") || !strings.Contains(cookie, "; SameSite=None") {
+		t.Errorf("Expected a Secure cookie with SameSite=None, got %s", cookie)
+	}
+}
+
+func TestAuthJWTMalformedLoginPayload(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	login := func(body string) *test.Recorded {
+		req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return test.RunRequest(t, handler, req)
+	}
+
+	for _, body := range []string{"", "username=admin&password=admin", `{"username": "admin", "password": 123}`} {
+		recorded := login(body)
+		recorded.CodeIs(400)
+		recorded.ContentTypeIsJson()
+		recorded.BodyIs(`{"Error":"Invalid login payload"}`)
+	}
+
+	// well formed, but wrong credentials
+	recorded := login(`{"username": "admin", "password": "wrong"}`)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTMaxTokenLength(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	var reason error
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"padding": strings.Repeat("x", 4096)}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		Unauthorized: func(writer rest.ResponseWriter, request *rest.Request, err error) {
+			reason = err
+			writer.WriteHeader(http.StatusUnauthorized)
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	if reason != ErrTokenTooLong {
+		t.Errorf("Expected %v, got %v", ErrTokenTooLong, reason)
+	}
+}
+
+func TestAuthJWTMultipleTokenLookups(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		TokenLookup: "header:Authorization, cookie:jwt, query:access_token",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	// no token anywhere
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// header absent, cookie present
+	cookieReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	cookieReq.AddCookie(&http.Cookie{Name: "jwt", Value: makeTokenString("admin", key)})
+	recorded = test.RunRequest(t, handler, cookieReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// header and cookie absent, query parameter present
+	queryReq := test.MakeSimpleRequest("GET", "http://localhost/?access_token="+makeTokenString("admin", key), nil)
+	recorded = test.RunRequest(t, handler, queryReq)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// the header takes precedence over the cookie
+	bothReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	bothReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	bothReq.AddCookie(&http.Cookie{Name: "jwt", Value: makeTokenString("admin", key)})
+	recorded = test.RunRequest(t, handler, bothReq)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTTokenResponseHeader(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 key,
+		MaxRefresh:          time.Hour * 24,
+		TokenResponseHeader: "X-Auth-Token",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, refreshApi.MakeHandler(), req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+
+	if rToken.Token == "" {
+		t.Fatal("Received refresh response without token")
+	}
+	recorded.HeaderIs("X-Auth-Token", rToken.Token)
+}
+
+func TestAuthJWTSlidingExpiration(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 key,
+		Timeout:             time.Hour,
+		MaxRefresh:          time.Hour,
+		SlidingExpiration:   true,
+		TokenResponseHeader: "X-Auth-Token",
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// far from expiry, the token is kept
+	now = issuedAt.Add(10 * time.Minute)
+	recorded := request(tokenString)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Auth-Token", "")
+
+	// within the window, the token is reissued
+	now = issuedAt.Add(40 * time.Minute)
+	recorded = request(tokenString)
+	recorded.CodeIs(200)
+
+	slidToken := recorded.Recorder.Header().Get("X-Auth-Token")
+	if slidToken == "" {
+		t.Fatal("Expected a reissued token")
+	}
+
+	// the reissued token outlives the original one
+	now = issuedAt.Add(80 * time.Minute)
+	recorded = request(tokenString)
+	recorded.CodeIs(401)
+
+	// but MaxRefresh has passed, so it isn't reissued anymore
+	recorded = request(slidToken)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Auth-Token", "")
+}
+
+func TestAuthJWTRefreshExpiredToken(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/refresh_token"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(url string, tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// the token has expired, but is still refreshable
+	now = issuedAt.Add(2 * time.Hour)
+	recorded := request("http://localhost/", tokenString)
+	recorded.CodeIs(401)
+
+	recorded = request("http://localhost/refresh_token", tokenString)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+
+	recorded = request("http://localhost/", rToken.Token)
+	recorded.CodeIs(200)
+
+	// the signature is still verified
+	forged := jwt.New(jwt.GetSigningMethod("HS256"))
+	forged.Claims["id"] = "admin"
+	forged.Claims["exp"] = issuedAt.Add(time.Hour).Unix()
+	forged.Claims["orig_iat"] = issuedAt.Unix()
+	forgedString, _ := forged.SignedString([]byte("sekret key sekret key sekret key"))
+	recorded = request("http://localhost/refresh_token", forgedString)
+	recorded.CodeIs(401)
+
+	// MaxRefresh has passed
+	now = issuedAt.Add(25 * time.Hour)
+	recorded = request("http://localhost/refresh_token", tokenString)
+	recorded.CodeIs(401)
+}
+
+func TestAuthJWTLoginRateLimiter(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	authenticated := 0
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		LoginRateLimiter: &MemoryLoginRateLimiter{
+			Burst:    3,
+			Interval: time.Minute,
+			TimeFunc: func() time.Time {
+				return now
+			},
+		},
+		Authenticator: func(userId string, password string) bool {
+			authenticated++
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	login := func(password string) *test.Recorded {
+		req := test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"username": "admin", "password": password})
+		req.RemoteAddr = "10.0.0.1:1234"
+		return test.RunRequest(t, handler, req)
+	}
+
+	for i := 0; i < 3; i++ {
+		login("wrong").CodeIs(401)
+	}
+
+	// the bucket is exhausted, even the right password is rejected without being checked
+	recorded := login("admin")
+	recorded.CodeIs(429)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Too many login attempts"}`)
+	recorded.HeaderIs("Retry-After", "60")
+
+	if authenticated != 3 {
+		t.Errorf("Expected 3 calls to the Authenticator, got %d", authenticated)
+	}
+
+	// an attempt is regained
+	now = now.Add(time.Minute)
+	recorded = login("admin")
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTVerificationAlgorithms(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrating from HS256 to RS256
+	authMiddleware := &JWTMiddleware{
+		Realm:                  "test zone",
+		SigningAlgorithm:       "RS256",
+		VerificationAlgorithms: []string{"RS256", "HS256"},
+		PrivKey:                privKey,
+		Key:                    key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// new tokens are signed with RS256
+	rsString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsToken, _ := jwt.Parse(rsString, func(token *jwt.Token) (interface{}, error) {
+		return &privKey.PublicKey, nil
+	})
+	if rsToken == nil || !rsToken.Valid || rsToken.Method.Alg() != "RS256" {
+		t.Fatal("Expected a valid RS256 token")
+	}
+	request(rsString).CodeIs(200)
+
+	// old HS256 tokens are still accepted
+	request(makeTokenString("admin", key)).CodeIs(200)
+
+	// but not those of another algorithm
+	esToken := jwt.New(jwt.GetSigningMethod("ES256"))
+	esToken.Claims["id"] = "admin"
+	esToken.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	esString, _ := esToken.SignedString(ecKey)
+	request(esString).CodeIs(401)
+
+	// nor HS256 tokens forged with the public RSA key
+	pubBytes, _ := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	request(makeTokenString("admin", pubPEM)).CodeIs(401)
+}
+
+func TestAuthJWTClaimsValidator(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	tenant := ""
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		PayloadFunc: func(userId string) map[string]interface{} {
+			if tenant == "" {
+				return nil
+			}
+			return map[string]interface{}{"tenant": tenant}
+		},
+		ClaimsValidator: func(claims map[string]interface{}, request *rest.Request) error {
+			switch claims["tenant"] {
+			case nil, "":
+				return errors.New("Missing tenant")
+			case "acme":
+				return nil
+			default:
+				return &HTTPError{Code: http.StatusForbidden, Message: "Unknown tenant"}
+			}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func() *test.Recorded {
+		tokenString, _, err := authMiddleware.GenerateToken("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := request()
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	tenant = "acme"
+	recorded = request()
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	tenant = "other"
+	recorded = request()
+	recorded.CodeIs(403)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Unknown tenant"}`)
+}
+
+func TestAuthJWTBasicAuthLogin(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:          "test zone",
+		Key:            []byte("secret key secret key secret key"),
+		BasicAuthLogin: true,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	// json payload
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// basic credentials
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.SetBasicAuth("admin", "admin")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	if nToken.Token == "" {
+		t.Error("Received login response without token")
+	}
+
+	// wrong basic credentials
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.SetBasicAuth("admin", "wrong")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// the json payload takes precedence
+	req = test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"username": "admin", "password": "wrong"})
+	req.SetBasicAuth("admin", "admin")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// basic credentials are ignored when not enabled
+	authMiddleware.BasicAuthLogin = false
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.SetBasicAuth("admin", "admin")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(400)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTNeedPrompt(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		NeedPrompt: true,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		Authorizator: func(userId string, request *rest.Request) bool {
+			return request.Method == "GET"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// no token
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone"`)
+
+	// malformed header
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone", error="invalid_request", error_description="Invalid auth header"`)
+
+	// expired token
+	expired := jwt.New(jwt.GetSigningMethod("HS256"))
+	expired.Claims["id"] = "admin"
+	expired.Claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	expiredString, _ := expired.SignedString(key)
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+expiredString)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone", error="invalid_token", error_description="Token is expired"`)
+
+	// denied by the Authorizator
+	req = test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone", error="insufficient_scope", error_description="Forbidden"`)
+}
+
+func TestAuthJWTIssuedAt(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshHandler := refreshApi.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		now = issuedAt.Add(time.Duration(i) * 30 * time.Minute)
+
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		recorded := test.RunRequest(t, refreshHandler, req)
+		recorded.CodeIs(200)
+		recorded.ContentTypeIsJson()
+
+		rToken := DecoderToken{}
+		test.DecodeJsonPayload(recorded.Recorder, &rToken)
+		tokenString = rToken.Token
+
+		token, err := authMiddleware.validateToken(tokenString, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if iat, _ := numericClaim(token.Claims, "iat"); iat != now.Unix() {
+			t.Errorf("Expected iat %d, got %d", now.Unix(), iat)
+		}
+		if origIat, _ := numericClaim(token.Claims, "orig_iat"); origIat != issuedAt.Unix() {
+			t.Errorf("Expected orig_iat %d, got %d", issuedAt.Unix(), origIat)
+		}
+	}
+}
+
+func TestAuthJWTOptional(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:    "test zone",
+		Key:      key,
+		Optional: true,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		userId, _ := r.Env["REMOTE_USER"].(string)
+		w.WriteJson(map[string]string{"Id": userId})
+	}))
+	handler := api.MakeHandler()
+
+	// anonymous
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Id":""}`)
+
+	// invalid token
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Id":""}`)
+
+	// authenticated
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Id":"admin"}`)
+}
+
+func TestAuthJWTExpiredCode(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		t.Error("Should never be executed")
+	}))
+	handler := api.MakeHandler()
+
+	expired := jwt.New(jwt.GetSigningMethod("HS256"))
+	expired.Claims["id"] = "admin"
+	expired.Claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	expiredString, _ := expired.SignedString(key)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+expiredString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Code":"token_expired","Error":"Not Authorized"}`)
+
+	// other failures carry no code
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Not Authorized"}`)
+}
+
+func TestAuthJWTKeyFunc(t *testing.T) {
+	vault := map[string][]byte{"current": []byte("secret key secret key secret key")}
+	var reason error
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		KeyFunc: func(token *jwt.Token) (interface{}, error) {
+			key, ok := vault["current"]
+			if !ok {
+				return nil, errors.New("Vault sealed")
+			}
+			return key, nil
+		},
+		SigningKeyFunc: func() (interface{}, error) {
+			key, ok := vault["current"]
+			if !ok {
+				return nil, errors.New("Vault sealed")
+			}
+			return key, nil
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+		Unauthorized: func(writer rest.ResponseWriter, request *rest.Request, err error) {
+			reason = err
+			writer.WriteHeader(http.StatusUnauthorized)
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	loginHandler := loginApi.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginHandler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+	request(nToken.Token).CodeIs(200)
+
+	// the key was rotated in the vault
+	vault["current"] = []byte("new secret key new secret key new")
+	request(nToken.Token).CodeIs(401)
+	request(makeTokenString("admin", vault["current"])).CodeIs(200)
+
+	// the vault is unavailable
+	delete(vault, "current")
+	request(nToken.Token).CodeIs(401)
+	if reason != ErrKeyUnavailable {
+		t.Errorf("Expected %v, got %v", ErrKeyUnavailable, reason)
+	}
+
+	recorded = test.RunRequest(t, loginHandler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(401)
+	if reason != ErrFailedTokenCreation {
+		t.Errorf("Expected %v, got %v", ErrFailedTokenCreation, reason)
+	}
+}
+
+func TestAuthJWTSetSubject(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         []byte("secret key secret key secret key"),
+		IdentityKey: "user",
+		SetSubject:  true,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authMiddleware.validateToken(tokenString, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Claims["user"] != "admin" || token.Claims["sub"] != "admin" {
+		t.Errorf("Expected user and sub claims admin, got %v and %v", token.Claims["user"], token.Claims["sub"])
+	}
+
+	authMiddleware.SetSubject = false
+	tokenString, _, _ = authMiddleware.GenerateToken("admin")
+	token, _ = authMiddleware.validateToken(tokenString, false)
+	if _, ok := token.Claims["sub"]; ok {
+		t.Error("Expected no sub claim by default")
+	}
+}
+
+func TestAuthJWTAllowPreflight(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:          "test zone",
+		Key:            []byte("secret key secret key secret key"),
+		AllowPreflight: true,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Method": r.Method})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("OPTIONS", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	// preflights are authenticated by default
+	authMiddleware.AllowPreflight = false
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("OPTIONS", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+func TestAuthJWTHMACKeyLengths(t *testing.T) {
+	key := func(length int) []byte {
+		return []byte(strings.Repeat("k", length))
+	}
+
+	cases := []struct {
+		algorithms []string
+		key        []byte
+		keys       map[string][]byte
+		valid      bool
+	}{
+		{[]string{"HS256"}, key(31), nil, false},
+		{[]string{"HS256"}, key(32), nil, true},
+		{[]string{"HS384"}, key(47), nil, false},
+		{[]string{"HS384"}, key(48), nil, true},
+		{[]string{"HS512"}, key(63), nil, false},
+		{[]string{"HS512"}, key(64), nil, true},
+		{[]string{"HS512"}, nil, map[string][]byte{"a": key(64), "b": key(32)}, false},
+		{[]string{"HS512"}, nil, map[string][]byte{"a": key(64), "b": key(64)}, true},
+		{[]string{"HS256", "HS512"}, key(48), nil, false},
+		{[]string{"RS256"}, nil, nil, true},
+	}
+
+	for _, c := range cases {
+		authMiddleware := &JWTMiddleware{
+			VerificationAlgorithms: c.algorithms,
+			Key:                    c.key,
+			Keys:                   c.keys,
+		}
+		err := authMiddleware.checkHMACKeyLengths()
+		if c.valid && err != nil {
+			t.Errorf("Expected %v with %d bytes long keys to be valid, got %v", c.algorithms, len(c.key), err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Expected %v with %d bytes long keys to be too short", c.algorithms, len(c.key))
+		}
+	}
+}
+
+func TestAuthJWTIdentityMapper(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	users := map[string]string{"admin@example.com": "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"}
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return password == "admin"
+		},
+		IdentityMapper: func(loginUserId string) (string, bool) {
+			identity, ok := users[loginUserId]
+			return identity, ok
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := loginApi.MakeHandler()
+
+	loginCreds := map[string]string{"username": "admin@example.com", "password": "admin"}
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	nToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &nToken)
+
+	token, err := authMiddleware.validateToken(nToken.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Claims["id"] != users["admin@example.com"] {
+		t.Errorf("Expected identity %s, got %v", users["admin@example.com"], token.Claims["id"])
+	}
+
+	// authenticated, but unknown to the mapper
+	unknownCreds := map[string]string{"username": "unknown@example.com", "password": "admin"}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", unknownCreds))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+}
+
+type failingWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *failingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *failingWriter) WriteJson(v interface{}) error {
+	return errors.New("connection reset by peer")
+}
+
+func (w *failingWriter) EncodeJson(v interface{}) ([]byte, error) {
+	return nil, errors.New("connection reset by peer")
+}
+
+func (w *failingWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestAuthJWTWriteFailure(t *testing.T) {
+	logger := &recordingLogger{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:  "test zone",
+		Key:    []byte("secret key secret key secret key"),
+		Logger: logger,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	login := func(password string) *failingWriter {
+		req := test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"username": "admin", "password": password})
+		writer := &failingWriter{header: http.Header{}}
+		authMiddleware.LoginHandler(writer, &rest.Request{Request: req, Env: map[string]interface{}{}})
+		return writer
+	}
+
+	if writer := login("admin"); writer.code != 200 {
+		t.Errorf("Expected 200, got %d", writer.code)
+	}
+	if writer := login("wrong"); writer.code != 401 {
+		t.Errorf("Expected 401, got %d", writer.code)
+	}
+
+	expected := "jwt: can't write response: connection reset by peer"
+	if len(logger.lines) != 2 || logger.lines[0] != expected || logger.lines[1] != expected {
+		t.Errorf("Expected the write failures to be logged, got %v", logger.lines)
+	}
+}
+
+func TestAuthJWTLogger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:  "test zone",
+		Key:    []byte("secret key secret key secret key"),
+		Logger: logger,
+		SigningKeyFunc: func() (interface{}, error) {
+			return nil, errors.New("Vault sealed")
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/", loginCreds))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	if len(logger.lines) != 1 || logger.lines[0] != "jwt: can't create token: Vault sealed" {
+		t.Errorf("Expected the signing failure to be logged, got %v", logger.lines)
+	}
+}
+
+func TestAuthJWTNew(t *testing.T) {
+	authenticator := func(userId string, password string) bool {
+		return userId == "admin" && password == "admin"
+	}
+	key := []byte("secret key secret key secret key")
+
+	cases := []struct {
+		name string
+		mw   JWTMiddleware
+		err  string
+	}{
+		{"no realm", JWTMiddleware{Key: key, Authenticator: authenticator}, "Realm is required"},
+		{"no key", JWTMiddleware{Realm: "test zone", Authenticator: authenticator}, "Key required"},
+		{"no rsa key", JWTMiddleware{Realm: "test zone", SigningAlgorithm: "RS256", Authenticator: authenticator}, "PrivKey or PubKey required for RS algorithms"},
+		{"no ecdsa key", JWTMiddleware{Realm: "test zone", SigningAlgorithm: "ES256", Authenticator: authenticator}, "ECPrivKey or ECPubKey required for ES algorithms"},
+		{"no authenticator", JWTMiddleware{Realm: "test zone", Key: key}, "Authenticator is required"},
+		{"none algorithm", JWTMiddleware{Realm: "test zone", Key: key, SigningAlgorithm: "none", Authenticator: authenticator}, "SigningAlgorithm none is not allowed"},
+		{"unknown algorithm", JWTMiddleware{Realm: "test zone", Key: key, SigningAlgorithm: "HS1024", Authenticator: authenticator}, "Invalid SigningAlgorithm HS1024"},
+	}
+
+	for _, c := range cases {
+		mw, err := New(c.mw)
+		if mw != nil || err == nil || err.Error() != c.err {
+			t.Errorf("%s: expected error %q, got %v", c.name, c.err, err)
+		}
+	}
+
+	mw, err := New(JWTMiddleware{
+		Realm:         "test zone",
+		KeyString:     string(key),
+		Authenticator: authenticator,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mw.Timeout != time.Hour || mw.IdentityKey != "id" {
+		t.Errorf("defaults not set: %+v", mw)
+	}
+
+	// A validated middleware is not validated again, KeyString and Key would clash otherwise.
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: mw,
+	})
+	api.SetApp(rest.AppSimple(mw.LoginHandler))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+}
+
+func TestAuthJWTRefreshGracePeriod(t *testing.T) {
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		Timeout:    48 * time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(at time.Duration) *test.Recorded {
+		now = issuedAt.Add(at)
+		req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// without grace period the token is refreshable until exactly MaxRefresh
+	refresh(24 * time.Hour).CodeIs(200)
+	refresh(24*time.Hour + time.Second).CodeIs(401)
+
+	authMiddleware.RefreshGracePeriod = 5 * time.Second
+	refresh(24*time.Hour + time.Second).CodeIs(200)
+	refresh(24*time.Hour + 5*time.Second).CodeIs(200)
+	refresh(24*time.Hour + 6*time.Second).CodeIs(401)
+}
+
+func TestAuthJWTLoadFromEnv(t *testing.T) {
+	key := "secret key secret key secret key"
+	os.Unsetenv("TEST_JWT_REALM")
+	os.Unsetenv("TEST_JWT_KEY")
+	defer os.Unsetenv("TEST_JWT_REALM")
+	defer os.Unsetenv("TEST_JWT_KEY")
+
+	authMiddleware := &JWTMiddleware{}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err == nil || err.Error() != "TEST_JWT_REALM is not set" {
+		t.Errorf("expected missing realm error, got %v", err)
+	}
+
+	os.Setenv("TEST_JWT_REALM", "test zone")
+	authMiddleware = &JWTMiddleware{}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err == nil || err.Error() != "TEST_JWT_KEY is not set" {
+		t.Errorf("expected missing key error, got %v", err)
+	}
+
+	os.Setenv("TEST_JWT_KEY", key)
+	authMiddleware = &JWTMiddleware{}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if authMiddleware.Realm != "test zone" || string(authMiddleware.Key) != key {
+		t.Errorf("realm or key not loaded: %q %q", authMiddleware.Realm, authMiddleware.Key)
+	}
+
+	// fields set in code take precedence
+	authMiddleware = &JWTMiddleware{Realm: "code zone", KeyString: "code key code key code key code"}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if authMiddleware.Realm != "code zone" || authMiddleware.Key != nil {
+		t.Errorf("fields set in code were overwritten: %q %q", authMiddleware.Realm, authMiddleware.Key)
+	}
+
+	// no HS key is needed for the other algorithms
+	os.Unsetenv("TEST_JWT_KEY")
+	authMiddleware = &JWTMiddleware{SigningAlgorithm: "RS256"}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err != nil || authMiddleware.Key != nil {
+		t.Errorf("unexpected key loading for RS256: %v %q", err, authMiddleware.Key)
+	}
+
+	// nor when the algorithm is inferred from an asymmetric key
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authMiddleware = &JWTMiddleware{PrivKey: privKey}
+	if err := authMiddleware.LoadFromEnv("TEST_JWT_"); err != nil || authMiddleware.Key != nil {
+		t.Errorf("unexpected key loading for an RSA key: %v %q", err, authMiddleware.Key)
+	}
+}
+
+func TestAuthJWTOrigIatKey(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		OrigIatKey: "session_start",
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	handler := api.MakeHandler()
+
+	// token issued by another system
+	sessionStart := now.Add(-time.Hour).Unix()
+	foreignToken := jwt.New(jwt.GetSigningMethod("HS256"))
+	foreignToken.Claims["id"] = "admin"
+	foreignToken.Claims["exp"] = now.Add(time.Minute).Unix()
+	foreignToken.Claims["session_start"] = sessionStart
+	tokenString, err := foreignToken.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	refreshed, err := authMiddleware.validateToken(rToken.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origIat, _ := numericClaim(refreshed.Claims, "session_start"); origIat != sessionStart {
+		t.Errorf("session_start not kept across refresh: %v", refreshed.Claims["session_start"])
+	}
+	if _, ok := refreshed.Claims["orig_iat"]; ok {
+		t.Errorf("unexpected orig_iat claim")
+	}
+
+	// the configured claim bounds the refreshes
+	now = now.Add(24 * time.Hour)
+	req = test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	req.Header.Set("Authorization", "Bearer "+rToken.Token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+}
+
+func TestAuthJWTIssuedBeforeCutoff(t *testing.T) {
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+	userCutoffs := map[string]time.Time{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		Timeout:    24 * time.Hour,
+		MaxRefresh: 48 * time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		MinIssuedAt: func(userId string) time.Time {
+			return userCutoffs[userId]
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	handler := authMiddleware.MiddlewareFunc(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	})
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(handler))
+	apiHandler := api.MakeHandler()
+
+	adminToken, _, _ := authMiddleware.GenerateToken("admin")
+	userToken, _, _ := authMiddleware.GenerateToken("user")
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, apiHandler, req)
+	}
+
+	now = issuedAt.Add(time.Hour)
+	request(adminToken).CodeIs(200)
+	request(userToken).CodeIs(200)
+
+	// per-user cutoff
+	userCutoffs["admin"] = now
+	request(adminToken).CodeIs(401)
+	request(userToken).CodeIs(200)
+
+	newAdminToken, _, _ := authMiddleware.GenerateToken("admin")
+	request(newAdminToken).CodeIs(200)
+
+	// refreshed tokens keep the start of their session
+	now = now.Add(time.Hour)
+	authMiddleware.NotBefore = now.Add(-time.Minute)
+	refreshed, _, err := authMiddleware.createToken("user", tokenSession{origIat: issuedAt.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(refreshed).CodeIs(401)
+
+	// global cutoff
+	request(userToken).CodeIs(401)
+	request(newAdminToken).CodeIs(401)
+
+	newUserToken, _, _ := authMiddleware.GenerateToken("user")
+	request(newUserToken).CodeIs(200)
+}
+
+func TestAuthJWTHTTPStatusForError(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{ErrNoAuthHeader, http.StatusUnauthorized},
+		{ErrInvalidAuthHeader, http.StatusUnauthorized},
+		{ErrNoAuthCookie, http.StatusUnauthorized},
+		{ErrNoAuthQueryParam, http.StatusUnauthorized},
+		{ErrNoAuthProtocol, http.StatusUnauthorized},
+		{ErrInvalidTokenLookup, http.StatusBadRequest},
+		{ErrTokenTooLong, http.StatusBadRequest},
+		{ErrInvalidSigningAlgorithm, http.StatusUnauthorized},
+		{ErrUnknownKID, http.StatusUnauthorized},
+		{ErrKeyUnavailable, http.StatusUnauthorized},
+		{ErrExpiredToken, http.StatusUnauthorized},
+		{ErrTokenNotValidYet, http.StatusUnauthorized},
+		{ErrInvalidToken, http.StatusUnauthorized},
+		{ErrInvalidIssuer, http.StatusUnauthorized},
+		{ErrInvalidAudience, http.StatusUnauthorized},
+		{ErrRevokedToken, http.StatusUnauthorized},
+		{ErrInvalidTokenType, http.StatusUnauthorized},
+		{ErrRefreshTokenReused, http.StatusUnauthorized},
+		{ErrTokenAlreadyUsed, http.StatusUnauthorized},
+		{ErrAuthenticatorUnavailable, http.StatusServiceUnavailable},
+		{ErrRefreshTooSoon, http.StatusTooManyRequests},
+		{ErrMissingClaim, http.StatusUnauthorized},
+		{ErrFingerprintMismatch, http.StatusUnauthorized},
+		{ErrInvalidIdentity, http.StatusUnauthorized},
+		{ErrForbidden, http.StatusUnauthorized},
+		{ErrInvalidLoginPayload, http.StatusBadRequest},
+		{ErrTooManyLoginAttempts, http.StatusTooManyRequests},
+		{ErrLoginDisabled, http.StatusServiceUnavailable},
+		{ErrFailedAuthentication, http.StatusUnauthorized},
+		{ErrInvalidOrigIat, http.StatusUnauthorized},
+		{ErrInactiveSession, http.StatusUnauthorized},
+		{ErrExpiredRefresh, http.StatusUnauthorized},
+		{ErrFailedTokenCreation, http.StatusUnauthorized},
+		{&HTTPError{Code: http.StatusForbidden, Message: "Read only access"}, http.StatusForbidden},
+		{errors.New("custom error"), http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		if code := HTTPStatusForError(c.err); code != c.code {
+			t.Errorf("%v: expected %d, got %d", c.err, c.code, code)
+		}
+	}
+}
+
+func TestAuthJWTWebSocketProtocol(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:       "test zone",
+		Key:         key,
+		TokenLookup: "header:Authorization, protocol:access_token",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	// token following the prefix, among other subprotocols
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", "chat, access_token, "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Sec-WebSocket-Protocol", "access_token")
+	recorded.BodyIs(`{"Id":"admin"}`)
+
+	// subprotocols split across several headers
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Add("Sec-WebSocket-Protocol", "access_token")
+	req.Header.Add("Sec-WebSocket-Protocol", makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Sec-WebSocket-Protocol", "access_token")
+
+	// prefix without token
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", "chat, access_token")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("Sec-WebSocket-Protocol", "")
+
+	// invalid token
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Sec-WebSocket-Protocol", "access_token, "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("Sec-WebSocket-Protocol", "")
+
+	// nothing is echoed for tokens read from elsewhere
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Sec-WebSocket-Protocol", "")
+}
+
+func TestAuthJWTRequiredClaims(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	claims := map[string]interface{}{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:          "test zone",
+		Key:            key,
+		RequiredClaims: []string{"tenant", "role"},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return claims
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func() *test.Recorded {
+		tokenString, _, err := authMiddleware.GenerateToken("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	claims = map[string]interface{}{"tenant": "acme"}
+	recorded := request()
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+
+	claims = map[string]interface{}{"tenant": "acme", "role": "admin"}
+	recorded = request()
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"admin"}`)
+}
+
+func TestAuthJWTKeyForTenant(t *testing.T) {
+	tenantKeys := map[string][]byte{
+		"acme":   []byte("acme key acme key acme key acme k"),
+		"globex": []byte("globex key globex key globex key"),
+	}
+	userTenants := map[string]string{"alice": "acme", "bob": "globex", "eve": "initech"}
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		KeyForTenant: func(tenant string) ([]byte, error) {
+			key, ok := tenantKeys[tenant]
+			if !ok {
+				return nil, errors.New("unknown tenant " + tenant)
+			}
+			return key, nil
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"tenant": userTenants[userId]}
+		},
+		Logger: &recordingLogger{},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	for user, tenant := range map[string]string{"alice": "acme", "bob": "globex"} {
+		tokenString, _, err := authMiddleware.GenerateToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := authMiddleware.validateToken(tokenString, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Header["kid"] != tenant {
+			t.Errorf("expected kid %s, got %v", tenant, token.Header["kid"])
+		}
+
+		recorded := request(tokenString)
+		recorded.CodeIs(200)
+		recorded.BodyIs(`{"Id":"` + user + `"}`)
+	}
+
+	// a tenant can't issue tokens for another one
+	forged := jwt.New(jwt.GetSigningMethod("HS256"))
+	forged.Header["kid"] = "globex"
+	forged.Claims["id"] = "alice"
+	forged.Claims["tenant"] = "acme"
+	forged.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	forgedString, _ := forged.SignedString(tenantKeys["globex"])
+	request(forgedString).CodeIs(401)
+
+	forged.Header["kid"] = "acme"
+	forgedString, _ = forged.SignedString(tenantKeys["globex"])
+	request(forgedString).CodeIs(401)
+
+	// unknown tenants can neither sign nor verify
+	if _, _, err := authMiddleware.GenerateToken("eve"); err == nil {
+		t.Errorf("expected signing to fail for an unknown tenant")
+	}
+	forged.Header["kid"] = "initech"
+	forged.Claims["tenant"] = "initech"
+	forgedString, _ = forged.SignedString(tenantKeys["globex"])
+	request(forgedString).CodeIs(401)
+}
+
+func TestAuthJWTKeyForTenantWeakKey(t *testing.T) {
+	weakKey := []byte("acme key")
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		KeyForTenant: func(tenant string) ([]byte, error) {
+			return weakKey, nil
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"tenant": "acme"}
+		},
+		Logger: &recordingLogger{},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	if _, _, err := authMiddleware.GenerateToken("alice"); err == nil {
+		t.Errorf("expected signing to fail with a weak tenant key")
+	}
+
+	forged := jwt.New(jwt.GetSigningMethod("HS256"))
+	forged.Header["kid"] = "acme"
+	forged.Claims["id"] = "alice"
+	forged.Claims["tenant"] = "acme"
+	forged.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	forgedString, _ := forged.SignedString(weakKey)
+	if _, err := authMiddleware.validateToken(forgedString, false); err == nil {
+		t.Errorf("expected verification to fail with a weak tenant key")
+	}
+
+	authMiddleware.AllowWeakKey = true
+	tokenString, _, err := authMiddleware.GenerateToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authMiddleware.validateToken(tokenString, false); err != nil {
+		t.Errorf("expected AllowWeakKey to accept weak tenant keys, got %v", err)
+	}
+}
+
+func TestAuthJWTKeyForTenantConfig(t *testing.T) {
+	keyForTenant := func(tenant string) ([]byte, error) {
+		return nil, errors.New("unknown tenant")
+	}
+	authenticator := func(userId string, password string) bool {
+		return false
+	}
+
+	if _, err := New(JWTMiddleware{Realm: "test zone", KeyForTenant: keyForTenant, SigningAlgorithm: "RS256", Authenticator: authenticator}); err == nil {
+		t.Errorf("expected KeyForTenant to require an HS algorithm")
+	}
+	if _, err := New(JWTMiddleware{Realm: "test zone", KeyForTenant: keyForTenant, Keys: map[string][]byte{"a": nil}, ActiveKID: "a", Authenticator: authenticator}); err == nil {
+		t.Errorf("expected KeyForTenant and Keys to be exclusive")
+	}
+	mw, err := New(JWTMiddleware{Realm: "test zone", KeyForTenant: keyForTenant, Authenticator: authenticator})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mw.TenantClaim != "tenant" {
+		t.Errorf("expected TenantClaim to default to tenant, got %q", mw.TenantClaim)
+	}
+}
+
+func TestAuthJWTSkipper(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Skipper: func(request *rest.Request) bool {
+			return request.URL.Path == "/healthz"
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		_, authenticated := r.Env["REMOTE_USER"]
+		w.WriteJson(map[string]bool{"Authenticated": authenticated})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/healthz", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Authenticated":false}`)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/private", nil))
+	recorded.CodeIs(401)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/private", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Authenticated":true}`)
+}
+
+func TestAuthJWTLoginResponseClaims(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		LoginResponseClaims: []string{"name", "roles", "missing"},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{
+				"name":        "Administrator",
+				"roles":       []string{"admin", "user"},
+				"employee_id": 42,
+			}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	response := struct {
+		Token string                 `json:"token"`
+		User  map[string]interface{} `json:"user"`
+	}{}
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+
+	if response.Token == "" {
+		t.Errorf("expected a token")
+	}
+	if response.User["name"] != "Administrator" {
+		t.Errorf("expected the name claim, got %v", response.User["name"])
+	}
+	if roles, ok := response.User["roles"].([]interface{}); !ok || len(roles) != 2 {
+		t.Errorf("expected the roles claim, got %v", response.User["roles"])
+	}
+	if len(response.User) != 2 {
+		t.Errorf("expected only the configured claims, got %v", response.User)
+	}
+
+	// no user object unless configured
+	authMiddleware.LoginResponseClaims = nil
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	if strings.Contains(recorded.Recorder.Body.String(), "user") {
+		t.Errorf("unexpected user object: %s", recorded.Recorder.Body.String())
+	}
+}
+
+func TestAuthJWTFingerprint(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		MaxRefresh: time.Hour,
+		FingerprintFunc: func(request *rest.Request) string {
+			nonce := ""
+			if cookie, err := request.Cookie("fingerprint"); err == nil {
+				nonce = cookie.Value
+			}
+			return request.UserAgent() + "\x00" + nonce
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login" && request.URL.Path != "/refresh_token"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	client := func(req *http.Request, userAgent string, nonce string) *http.Request {
+		req.Header.Set("User-Agent", userAgent)
+		req.AddCookie(&http.Cookie{Name: "fingerprint", Value: nonce})
+		return req
+	}
+	request := func(url string, tokenString string, userAgent string, nonce string) *test.Recorded {
+		req := client(test.MakeSimpleRequest("GET", url, nil), userAgent, nonce)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	loginReq := client(test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}), "browser", "nonce")
+	recorded := test.RunRequest(t, handler, loginReq)
+	recorded.CodeIs(200)
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+
+	// the client the token was issued to
+	request("http://localhost/", rToken.Token, "browser", "nonce").CodeIs(200)
+
+	// stolen token
+	request("http://localhost/", rToken.Token, "browser", "other nonce").CodeIs(401)
+	request("http://localhost/", rToken.Token, "curl", "nonce").CodeIs(401)
+	request("http://localhost/refresh_token", rToken.Token, "curl", "nonce").CodeIs(401)
+
+	// refreshed tokens stay bound
+	recorded = request("http://localhost/refresh_token", rToken.Token, "browser", "nonce")
+	recorded.CodeIs(200)
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	request("http://localhost/", rToken.Token, "browser", "nonce").CodeIs(200)
+	request("http://localhost/", rToken.Token, "curl", "nonce").CodeIs(401)
+
+	// tokens created outside of the login aren't bound
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request("http://localhost/", tokenString, "curl", "").CodeIs(200)
+}
+
+func TestAuthJWTValidateHandler(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:   "test zone",
+		Key:     key,
+		Timeout: time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"role": "admin"}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.ValidateHandler))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(tokenString string) *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/validate", map[string]string{"token": tokenString}))
+	}
+
+	// valid token in the payload
+	recorded := validate(tokenString)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	response := struct {
+		Valid  bool                   `json:"valid"`
+		Claims map[string]interface{} `json:"claims"`
+	}{}
+	test.DecodeJsonPayload(recorded.Recorder, &response)
+	if !response.Valid || response.Claims["id"] != "admin" || response.Claims["role"] != "admin" {
+		t.Errorf("unexpected response: %+v", response)
+	}
+
+	// valid token in the header
+	req := test.MakeSimpleRequest("POST", "http://localhost/validate", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	// tampered token
+	parts := strings.Split(tokenString, ".")
+	tampered := parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))
+	validate(tampered).CodeIs(401)
+	validate(makeTokenString("admin", []byte("sekret key sekret key sekret key"))).CodeIs(401)
+
+	// expired token
+	now = now.Add(2 * time.Hour)
+	recorded = validate(tokenString)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Code":"token_expired","Error":"Not Authorized"}`)
+}
+
+func TestAuthJWTRefreshPayload(t *testing.T) {
+	roles := []string{"user"}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		MaxRefresh: time.Hour,
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"roles": roles}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the roles of the user change after the token was issued
+	roles = []string{"user", "admin"}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	refreshed, err := authMiddleware.validateToken(rToken.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshedRoles, _ := refreshed.Claims["roles"].([]interface{})
+	if len(refreshedRoles) != 2 || refreshedRoles[1] != "admin" {
+		t.Errorf("expected the refreshed token to carry the new roles, got %v", refreshed.Claims["roles"])
+	}
+}
+
+func TestAuthJWTLoginEnabled(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	enabled := false
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		LoginEnabled: func() bool {
+			return enabled
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	login := func() *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	}
+
+	recorded := login()
+	recorded.CodeIs(503)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Login is temporarily disabled"}`)
+
+	// existing tokens stay valid
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	enabled = true
+	login().CodeIs(200)
+}
+
+func TestAuthJWTIdentityIfPresent(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		if id, ok := authMiddleware.IdentityIfPresent(r); ok {
+			w.WriteJson(map[string]string{"Greeting": "Hello " + id})
+			return
+		}
+		w.WriteJson(map[string]string{"Greeting": "Hello stranger"})
+	}))
+	handler := api.MakeHandler()
+
+	// present
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Greeting":"Hello admin"}`)
+
+	// absent
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Greeting":"Hello stranger"}`)
+
+	// invalid
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", []byte("sekret key sekret key sekret key")))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Greeting":"Hello stranger"}`)
+}
+
+func TestAuthJWTOnAuthorized(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	permissions := map[string][]string{"admin": {"read", "write"}}
+	lookups := 0
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authorizator: func(userId string, request *rest.Request) bool {
+			lookups++
+			return len(permissions[userId]) != 0
+		},
+		OnAuthorized: func(userId string, request *rest.Request) {
+			if request.Env["REMOTE_USER"] != userId {
+				t.Errorf("expected REMOTE_USER to be set before the hook")
+			}
+			request.Env["PERMISSIONS"] = permissions[userId]
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]interface{}{"Permissions": r.Env["PERMISSIONS"]})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Permissions":["read","write"]}`)
+
+	// not called for denied requests
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	nobodyToken, _, err := authMiddleware.GenerateToken("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+nobodyToken)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	if lookups != 2 {
+		t.Errorf("expected one authorization per request, got %d", lookups)
+	}
+}
+
+func TestAuthJWTLoginFields(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:         "test zone",
+		Key:           []byte("secret key secret key secret key"),
+		UsernameField: "email",
+		PasswordField: "pass",
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin@example.com" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := api.MakeHandler()
+
+	login := func(payload interface{}) *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", payload))
+	}
+
+	recorded := login(map[string]string{"email": "admin@example.com", "pass": "admin"})
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// the default field names aren't read anymore
+	login(map[string]string{"username": "admin@example.com", "password": "admin"}).CodeIs(401)
+
+	// credentials must be strings
+	login(map[string]interface{}{"email": "admin@example.com", "pass": 1234}).CodeIs(400)
+}
+
+func TestAuthJWTAuthHeaderWhitespace(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	tokenString := makeTokenString("admin", key)
+	cases := []struct {
+		header string
+		code   int
+	}{
+		{"Bearer " + tokenString, 200},
+		{"bearer " + tokenString, 200},
+		{"BEARER " + tokenString, 200},
+		{"Bearer  " + tokenString, 200},
+		{"Bearer\t" + tokenString, 200},
+		{"  Bearer " + tokenString + " ", 200},
+		{"Bearer", 401},
+		{"Bearer " + tokenString + " extra", 401},
+		{"Basic " + tokenString, 401},
+		{"Bearer" + tokenString, 401},
+	}
+
+	for _, c := range cases {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", c.header)
+		recorded := test.RunRequest(t, handler, req)
+		if recorded.Recorder.Code != c.code {
+			t.Errorf("%q: expected %d, got %d", c.header, c.code, recorded.Recorder.Code)
+		}
+	}
+}
+
+func TestAuthJWTOneTimeToken(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		Timeout:    time.Hour,
+		MaxRefresh: time.Hour * 24,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	if _, _, err := authMiddleware.GenerateOneTimeToken("admin", time.Minute); err == nil {
+		t.Errorf("expected an error without OneTimeTokenStore")
+	}
+
+	authMiddleware.OneTimeTokenStore = &MemoryRevocationStore{}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	tokenString, _, err := authMiddleware.GenerateOneTimeToken("admin", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// first use succeeds
+	recorded := request(tokenString)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"admin"}`)
+
+	// second use fails
+	request(tokenString).CodeIs(401)
+
+	// regular tokens can still be used repeatedly
+	regular := makeTokenString("admin", key)
+	request(regular).CodeIs(200)
+	request(regular).CodeIs(200)
+
+	// one-time tokens can't be refreshed
+	otherToken, _, err := authMiddleware.GenerateOneTimeToken("admin", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	refreshReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+otherToken)
+	test.RunRequest(t, refreshApi.MakeHandler(), refreshReq).CodeIs(401)
+
+	// without a store one-time tokens are rejected
+	authMiddleware.OneTimeTokenStore = nil
+	request(otherToken).CodeIs(401)
+}
+
+func TestAuthJWTOneTimeTokenOutsideMiddleware(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:             "test zone",
+		Key:               []byte("secret key secret key secret key"),
+		OneTimeTokenStore: &MemoryRevocationStore{},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	newRequest := func(tokenString string) *rest.Request {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return &rest.Request{Request: req, PathParams: map[string]string{}, Env: map[string]interface{}{}}
+	}
+	generate := func() string {
+		tokenString, _, err := authMiddleware.GenerateOneTimeToken("admin", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tokenString := generate()
+	if _, ok := authMiddleware.IdentityIfPresent(newRequest(tokenString)); !ok {
+		t.Errorf("expected IdentityIfPresent to accept the first use")
+	}
+	if _, ok := authMiddleware.IdentityIfPresent(newRequest(tokenString)); ok {
+		t.Errorf("expected IdentityIfPresent to reject the second use")
+	}
+
+	tokenString = generate()
+	var claims struct {
+		Id string `json:"id"`
+	}
+	if err := authMiddleware.BindClaims(newRequest(tokenString), &claims); err != nil || claims.Id != "admin" {
+		t.Errorf("expected BindClaims to accept the first use, got %v", err)
+	}
+	if err := authMiddleware.BindClaims(newRequest(tokenString), &claims); err != ErrTokenAlreadyUsed {
+		t.Errorf("expected BindClaims to reject the second use, got %v", err)
+	}
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.ValidateHandler))
+	handler := api.MakeHandler()
+	tokenString = generate()
+	validate := func() *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"token": tokenString}))
+	}
+	validate().CodeIs(200)
+	validate().CodeIs(401)
+
+	// a token consumed by the middleware isn't consumed again by the handler
+	identities := []bool{}
+	api = rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		_, ok := authMiddleware.IdentityIfPresent(r)
+		identities = append(identities, ok)
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+generate())
+	test.RunRequest(t, api.MakeHandler(), req).CodeIs(200)
+	if len(identities) != 1 || !identities[0] {
+		t.Errorf("expected IdentityIfPresent to accept the token consumed by the middleware, got %v", identities)
+	}
+}
+
+func TestAuthJWTResponseEnvelope(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 key,
+		Timeout:             time.Hour,
+		MaxRefresh:          time.Hour * 24,
+		ResponseContentType: "application/vnd.api+json",
+		ResponseEnvelope: func(response map[string]interface{}) interface{} {
+			return map[string]interface{}{"data": response, "error": nil}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	type envelope struct {
+		Data struct {
+			Token  string `json:"token"`
+			Expire string `json:"expire"`
+		} `json:"data"`
+		Error *string `json:"error"`
+	}
+
+	loginApi := rest.NewApi()
+	loginApi.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+
+	recorded := test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "application/vnd.api+json")
+	if !strings.Contains(recorded.Recorder.Body.String(), `"error":null`) {
+		t.Errorf("expected a null error, got %s", recorded.Recorder.Body.String())
+	}
+
+	login := envelope{}
+	test.DecodeJsonPayload(recorded.Recorder, &login)
+	if login.Data.Token == "" || login.Data.Expire == "" {
+		t.Errorf("expected the token in the envelope, got %s", recorded.Recorder.Body.String())
+	}
+
+	refreshApi := rest.NewApi()
+	refreshApi.Use(authMiddleware)
+	refreshApi.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+
+	refreshReq := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+login.Data.Token)
+	recorded = test.RunRequest(t, refreshApi.MakeHandler(), refreshReq)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "application/vnd.api+json")
+
+	refresh := envelope{}
+	test.DecodeJsonPayload(recorded.Recorder, &refresh)
+	if refresh.Data.Token == "" {
+		t.Errorf("expected the refreshed token in the envelope, got %s", recorded.Recorder.Body.String())
+	}
+
+	// the default response stays bare
+	authMiddleware.ResponseEnvelope = nil
+	authMiddleware.ResponseContentType = ""
+	recorded = test.RunRequest(t, loginApi.MakeHandler(), test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	bare := map[string]interface{}{}
+	test.DecodeJsonPayload(recorded.Recorder, &bare)
+	if _, ok := bare["token"]; !ok {
+		t.Errorf("expected a bare response, got %v", bare)
+	}
+}
+
+func TestAuthJWTVerifyRSIssueHS(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	providerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the public key of the identity provider is known
+	authMiddleware := &JWTMiddleware{
+		Realm:                  "test zone",
+		SigningAlgorithm:       "HS256",
+		VerificationAlgorithms: []string{"HS256", "RS256"},
+		Key:                    key,
+		PubKey:                 &providerKey.PublicKey,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// new tokens are still signed with HS256
+	hsString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsToken, _ := jwt.Parse(hsString, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	if hsToken == nil || !hsToken.Valid || hsToken.Method.Alg() != "HS256" {
+		t.Fatal("Expected a valid HS256 token")
+	}
+	request(hsString).CodeIs(200)
+
+	// RS256 tokens of the identity provider are accepted
+	rsToken := jwt.New(jwt.GetSigningMethod("RS256"))
+	rsToken.Claims["id"] = "idp-user"
+	rsToken.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	rsString, err := rsToken.SignedString(providerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := request(rsString)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"idp-user"}`)
+
+	// but not those signed by another RSA key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := rsToken.SignedString(otherKey)
+	request(forged).CodeIs(401)
+
+	// nor HS256 tokens forged with the public RSA key
+	pubBytes, _ := x509.MarshalPKIXPublicKey(&providerKey.PublicKey)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	request(makeTokenString("admin", pubPEM)).CodeIs(401)
+
+	// the public key is required to verify RS256
+	err = (&JWTMiddleware{
+		Realm:                  "test zone",
+		VerificationAlgorithms: []string{"HS256", "RS256"},
+		Key:                    key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}).setup()
+	if err == nil {
+		t.Error("expected an error without PubKey")
+	}
+}
+
+func TestAuthJWTBindClaims(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"tenant": "acme", "roles": []string{"admin", "user"}}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	type claims struct {
+		Id     string   `json:"id"`
+		Tenant string   `json:"tenant"`
+		Roles  []string `json:"roles"`
+		Exp    int64    `json:"exp"`
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		bound := claims{}
+		if err := authMiddleware.BindClaims(r, &bound); err != nil {
+			rest.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteJson(bound)
+	}))
+
+	tokenString, expire, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(200)
+
+	bound := claims{}
+	test.DecodeJsonPayload(recorded.Recorder, &bound)
+	if bound.Id != "admin" || bound.Tenant != "acme" || bound.Exp != expire.Unix() {
+		t.Errorf("unexpected claims %+v", bound)
+	}
+	if len(bound.Roles) != 2 || bound.Roles[0] != "admin" || bound.Roles[1] != "user" {
+		t.Errorf("unexpected roles %v", bound.Roles)
+	}
+
+	// outside of the middleware the token of the request is parsed
+	r := &rest.Request{Request: req, PathParams: map[string]string{}, Env: map[string]interface{}{}}
+	bound = claims{}
+	if err := authMiddleware.BindClaims(r, &bound); err != nil || bound.Tenant != "acme" {
+		t.Errorf("expected the claims of the request, got %+v, %v", bound, err)
+	}
+
+	r.Request = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	if err := authMiddleware.BindClaims(r, &claims{}); err != ErrNoAuthHeader {
+		t.Errorf("expected ErrNoAuthHeader, got %v", err)
+	}
+
+	// mismatching types are reported
+	r.Env["JWT_PAYLOAD"] = map[string]interface{}{"tenant": 42}
+	if err := authMiddleware.BindClaims(r, &claims{}); err == nil {
+		t.Error("expected an error for a mismatching claim type")
+	}
+}
+
+func TestAuthJWTAuthenticatorWithContext(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   []byte("secret key secret key secret key"),
+		AuthenticatorWithContext: func(ctx context.Context, userId string, password string) (bool, error) {
+			switch userId {
+			case "slow":
+				// the identity store hangs until the client gives up
+				<-ctx.Done()
+				return false, nil
+			case "broken":
+				return false, errors.New("identity store unreachable")
+			}
+			return userId == "admin" && password == "admin", nil
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.LoginHandler))
+	handler := api.MakeHandler()
+
+	login := func(username string, ctx context.Context) *test.Recorded {
+		req := test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": username, "password": "admin"})
+		return test.RunRequest(t, handler, req.WithContext(ctx))
+	}
+
+	login("admin", context.Background()).CodeIs(200)
+	login("nobody", context.Background()).CodeIs(401)
+
+	// canceled login
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorded := login("slow", ctx)
+	recorded.CodeIs(503)
+	recorded.BodyIs(`{"Error":"Authenticator unavailable"}`)
+
+	// timed out login
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	login("slow", ctx).CodeIs(503)
+
+	// failing identity store
+	login("broken", context.Background()).CodeIs(503)
+}
+
+func TestAuthJWTIssuedAtLeeway(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		Key:              key,
+		VerifyIssuedAt:   true,
+		Leeway:           5 * time.Second,
+		IssuedAtBackdate: 10 * time.Second,
+		MaxRefresh:       time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	makeToken := func(issuedIn time.Duration) string {
+		token := jwt.New(jwt.GetSigningMethod("HS256"))
+		token.Claims["id"] = "admin"
+		token.Claims["iat"] = now.Add(issuedIn).Unix()
+		token.Claims["exp"] = now.Add(time.Hour).Unix()
+		tokenString, _ := token.SignedString(key)
+		return tokenString
+	}
+
+	// slightly in the future, within the leeway
+	if _, err := authMiddleware.validateToken(makeToken(2*time.Second), false); err != nil {
+		t.Errorf("expected a token issued within the leeway to validate, got %v", err)
+	}
+
+	// beyond the leeway
+	if _, err := authMiddleware.validateToken(makeToken(time.Minute), false); err != ErrTokenNotValidYet {
+		t.Errorf("expected ErrTokenNotValidYet, got %v", err)
+	}
+
+	// iat isn't validated by default
+	authMiddleware.VerifyIssuedAt = false
+	if _, err := authMiddleware.validateToken(makeToken(time.Minute), false); err != nil {
+		t.Errorf("expected iat not to be validated, got %v", err)
+	}
+
+	// issued tokens are backdated, but not their refresh window
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := authMiddleware.validateToken(tokenString, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iat, _ := numericClaim(token.Claims, "iat"); iat != now.Add(-10*time.Second).Unix() {
+		t.Errorf("expected a backdated iat, got %d", iat)
+	}
+	if origIat, _ := numericClaim(token.Claims, "orig_iat"); origIat != now.Unix() {
+		t.Errorf("expected orig_iat not to be backdated, got %d", origIat)
+	}
+}
+
+func TestAuthJWTStringNumericClaims(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	makeToken := func(claims map[string]interface{}) string {
+		token := jwt.New(jwt.GetSigningMethod("HS256"))
+		token.Claims["id"] = "admin"
+		for name, value := range claims {
+			token.Claims[name] = value
+		}
+		tokenString, _ := token.SignedString(key)
+		return tokenString
+	}
+	unix := func(t time.Time) string {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"valid exp", map[string]interface{}{"exp": unix(now.Add(time.Minute))}, nil},
+		{"expired exp", map[string]interface{}{"exp": unix(now.Add(-time.Minute))}, ErrExpiredToken},
+		{"exponent exp", map[string]interface{}{"exp": "1.0001e6"}, nil},
+		{"future nbf", map[string]interface{}{"exp": unix(now.Add(time.Hour)), "nbf": unix(now.Add(time.Minute))}, ErrTokenNotValidYet},
+		{"malformed exp", map[string]interface{}{"exp": "tomorrow"}, ErrInvalidToken},
+		{"malformed nbf", map[string]interface{}{"nbf": "NaN"}, ErrInvalidToken},
+	}
+
+	for _, c := range cases {
+		if _, err := authMiddleware.validateToken(makeToken(c.claims), false); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	// orig_iat encoded as a string can still be refreshed
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	handler := api.MakeHandler()
+
+	refresh := func(origIat time.Time) *test.Recorded {
+		tokenString := makeToken(map[string]interface{}{"exp": unix(now.Add(time.Minute)), "orig_iat": unix(origIat)})
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := refresh(now.Add(-time.Minute))
+	recorded.CodeIs(200)
+	refreshed := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+	token, err := authMiddleware.validateToken(refreshed.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origIat, _ := numericClaim(token.Claims, "orig_iat"); origIat != now.Add(-time.Minute).Unix() {
+		t.Errorf("expected orig_iat to be kept, got %v", token.Claims["orig_iat"])
+	}
+
+	refresh(now.Add(-2 * time.Hour)).CodeIs(401)
+}
+
+func TestAuthJWTInferSigningAlgorithm(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		mw        JWTMiddleware
+		algorithm string
+		valid     bool
+	}{
+		{"secret key", JWTMiddleware{Key: key}, "HS256", true},
+		{"secret key explicit", JWTMiddleware{Key: key, SigningAlgorithm: "HS512", AllowWeakKey: true}, "HS512", true},
+		{"rsa key", JWTMiddleware{PrivKey: rsaKey}, "RS256", true},
+		{"rsa key explicit", JWTMiddleware{PrivKey: rsaKey, SigningAlgorithm: "RS384"}, "RS384", true},
+		{"rsa public key", JWTMiddleware{PubKey: &rsaKey.PublicKey}, "RS256", true},
+		{"ecdsa key", JWTMiddleware{ECPrivKey: p256Key}, "ES256", true},
+		{"ecdsa P-384 key", JWTMiddleware{ECPrivKey: p384Key}, "ES384", true},
+		{"ecdsa key explicit", JWTMiddleware{ECPrivKey: p256Key, SigningAlgorithm: "ES256"}, "ES256", true},
+		{"ecdsa public key", JWTMiddleware{ECPubKey: &p384Key.PublicKey}, "ES384", true},
+		{"secret key with rsa public key", JWTMiddleware{Key: key, PubKey: &rsaKey.PublicKey}, "HS256", true},
+		{"rsa algorithm with ecdsa key", JWTMiddleware{ECPrivKey: p256Key, SigningAlgorithm: "RS256"}, "", false},
+		{"ecdsa algorithm with rsa key", JWTMiddleware{PrivKey: rsaKey, SigningAlgorithm: "ES256"}, "", false},
+		{"ecdsa algorithm with another curve", JWTMiddleware{ECPrivKey: p256Key, SigningAlgorithm: "ES384"}, "", false},
+		{"hmac algorithm with rsa key only", JWTMiddleware{PrivKey: rsaKey, SigningAlgorithm: "HS256"}, "", false},
+	}
+
+	for _, c := range cases {
+		mw := c.mw
+		mw.Realm = "test zone"
+		mw.Authenticator = func(userId string, password string) bool {
+			return false
+		}
+
+		authMiddleware, err := New(mw)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if authMiddleware.SigningAlgorithm != c.algorithm {
+			t.Errorf("%s: expected %s, got %s", c.name, c.algorithm, authMiddleware.SigningAlgorithm)
+		}
+
+		// tokens can be issued and verified with the inferred algorithm
+		if mw.PrivKey == nil && mw.ECPrivKey == nil && mw.Key == nil {
+			continue
+		}
+		tokenString, _, err := authMiddleware.GenerateToken("admin")
+		if err != nil {
+			t.Errorf("%s: can't generate token: %v", c.name, err)
+			continue
+		}
+		if token, err := authMiddleware.validateToken(tokenString, false); err != nil || token.Method.Alg() != c.algorithm {
+			t.Errorf("%s: expected a valid %s token, got %v", c.name, c.algorithm, err)
+		}
+	}
+}
+
+func TestAuthJWTNeedPromptJsonBody(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		NeedPrompt: true,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+		AuthorizatorWithError: func(userId string, request *rest.Request) error {
+			if request.Method == "DELETE" {
+				return &HTTPError{Code: http.StatusUnauthorized, Message: "Step-up authentication required"}
+			}
+			return nil
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// both the challenge and a json body
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone"`)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Not Authorized"}`)
+
+	// custom status codes keep the challenge too
+	req := test.MakeSimpleRequest("DELETE", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone", error="invalid_token", error_description="Step-up authentication required"`)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Error":"Step-up authentication required"}`)
+
+	// and so do custom error bodies
+	authMiddleware.Unauthorized = func(writer rest.ResponseWriter, request *rest.Request, reason error) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		writer.WriteJson(map[string]string{"message": reason.Error()})
+	}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone"`)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"message":"Auth header empty"}`)
+}
+
+func TestAuthJWTMinRefreshInterval(t *testing.T) {
+	now := time.Unix(1000000, 0)
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		Timeout:             time.Hour,
+		MaxRefresh:          time.Hour * 24,
+		RefreshTokenTimeout: time.Hour * 24,
+		MinRefreshInterval:  time.Minute,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh", authMiddleware.RefreshHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+	)
+	api.SetApp(router)
+	authMiddleware.MiddlewareFunc(nil)
+	handler := api.MakeHandler()
+
+	type tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	refresh := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/refresh", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	login := tokens{}
+	test.DecodeJsonPayload(recorded.Recorder, &login)
+
+	// back-to-back refreshes hit the limit
+	recorded = refresh(login.Token)
+	recorded.CodeIs(429)
+	recorded.HeaderIs("Retry-After", "60")
+	recorded.BodyIs(`{"Error":"Token refreshed too soon"}`)
+
+	now = now.Add(30 * time.Second)
+	recorded = refresh(login.Token)
+	recorded.CodeIs(429)
+	recorded.HeaderIs("Retry-After", "30")
+
+	now = now.Add(30 * time.Second)
+	recorded = refresh(login.Token)
+	recorded.CodeIs(200)
+	refreshed := tokens{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+
+	// the refreshed token is throttled in turn
+	refresh(refreshed.Token).CodeIs(429)
+
+	// and so are the refresh tokens
+	refreshToken := func() *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", map[string]string{"refresh_token": login.RefreshToken}))
+	}
+	refreshToken().CodeIs(200)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	test.DecodeJsonPayload(recorded.Recorder, &login)
+	now = now.Add(500 * time.Millisecond)
+	recorded = refreshToken()
+	recorded.CodeIs(429)
+	recorded.HeaderIs("Retry-After", "60")
+	now = now.Add(time.Minute)
+	refreshToken().CodeIs(200)
+}
+
+func TestAuthJWTRealmFunc(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Key:        key,
+		NeedPrompt: true,
+		RealmFunc: func(request *rest.Request) string {
+			switch request.Host {
+			case "billing.example.com":
+				return "billing"
+			case "admin.example.com":
+				return "admin"
+			}
+			return ""
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	// Realm is optional with a RealmFunc
+	if err := authMiddleware.setup(); err != nil {
+		t.Fatal(err)
+	}
+	authMiddleware.initialized = true
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	challenge := func(url string) string {
+		recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", url, nil))
+		recorded.CodeIs(401)
+		return recorded.Recorder.Header().Get("WWW-Authenticate")
+	}
+
+	if header := challenge("http://billing.example.com/"); header != `Bearer realm="billing"` {
+		t.Errorf("unexpected challenge for billing: %s", header)
+	}
+	if header := challenge("http://admin.example.com/"); header != `Bearer realm="admin"` {
+		t.Errorf("unexpected challenge for admin: %s", header)
+	}
+
+	// an empty realm falls back to Realm
+	authMiddleware.Realm = "test zone"
+	if header := challenge("http://localhost/"); header != `Bearer realm="test zone"` {
+		t.Errorf("unexpected fallback challenge: %s", header)
+	}
+}
@@ -0,0 +1,35 @@
+package jwt
+
+import (
+	"context"
+)
+
+type contextKey int
+
+const (
+	identityContextKey contextKey = iota
+	claimsContextKey
+)
+
+// newContext returns a copy of ctx carrying the identity and the claims of the authenticated
+// user.
+func newContext(ctx context.Context, userId string, claims map[string]interface{}) context.Context {
+	ctx = context.WithValue(ctx, identityContextKey, userId)
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// IdentityFromContext returns the userId of the request authenticated by the JWTMiddleware, from
+// the context of the request, e.g. IdentityFromContext(request.Context()).
+// The boolean is false for unauthenticated requests.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	userId, ok := ctx.Value(identityContextKey).(string)
+	return userId, ok
+}
+
+// ClaimsFromContext returns the decoded claims of the token of the request authenticated by the
+// JWTMiddleware, from the context of the request. The boolean is false for unauthenticated
+// requests.
+func ClaimsFromContext(ctx context.Context) (map[string]interface{}, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims, ok
+}
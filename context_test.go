@@ -0,0 +1,47 @@
+package jwt
+
+import (
+	"context"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"testing"
+)
+
+func TestContext(t *testing.T) {
+	if _, ok := IdentityFromContext(context.Background()); ok {
+		t.Error("Empty context is expected to carry no identity")
+	}
+	if _, ok := ClaimsFromContext(context.Background()); ok {
+		t.Error("Empty context is expected to carry no claims")
+	}
+
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm: "test zone",
+		Key:   key,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		userId, ok := IdentityFromContext(r.Context())
+		if !ok || userId != "admin" {
+			t.Errorf("Expected identity admin in the context, got %s", userId)
+		}
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok || claims["id"] != "admin" {
+			t.Errorf("Expected the claims in the context, got %v", claims)
+		}
+		w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+	}))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+}
@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type introspectionResult struct {
+	claims map[string]interface{}
+	expire time.Time
+}
+
+// introspector asks an OAuth 2.0 introspection endpoint (RFC 7662) whether opaque tokens are
+// active, and caches the positive answers until the tokens expire.
+type introspector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	identityKey  string
+	client       *http.Client
+	logger       Logger
+
+	mutex   sync.Mutex
+	results map[string]introspectionResult
+	// size of results triggering the next pruning
+	pruneAt int
+}
+
+func newIntrospector(url string, clientID string, clientSecret string, identityKey string, logger Logger) *introspector {
+	return &introspector{
+		url:          url,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		identityKey:  identityKey,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		logger:       logger,
+		results:      map[string]introspectionResult{},
+	}
+}
+
+// isOpaqueToken reports whether tokenString is neither a JWT nor a JWE, whose compact forms
+// have three and five parts.
+func isOpaqueToken(tokenString string) bool {
+	dots := strings.Count(tokenString, ".")
+	return dots != 2 && dots != 4
+}
+
+// introspect returns the claims of tokenString if the endpoint reports it active at now. The sub
+// claim is copied to the identity claim, unless the endpoint returned one.
+func (in *introspector) introspect(tokenString string, now time.Time) (map[string]interface{}, error) {
+	in.mutex.Lock()
+	result, ok := in.results[tokenString]
+	in.mutex.Unlock()
+
+	if ok && now.Before(result.expire) {
+		return copyClaims(result.claims), nil
+	}
+
+	claims, err := in.request(tokenString)
+	if err != nil {
+		in.logger.Printf("jwt: can't introspect token at %s: %v", in.url, err)
+		return nil, ErrInvalidToken
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInvalidToken
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if ok && exp <= now.Unix() {
+		return nil, ErrExpiredToken
+	}
+
+	if _, ok := claims[in.identityKey].(string); !ok {
+		if sub, ok := claims["sub"].(string); ok {
+			claims[in.identityKey] = sub
+		}
+	}
+
+	// tokens without exp are introspected on every request
+	if ok {
+		in.cache(tokenString, introspectionResult{copyClaims(claims), time.Unix(exp, 0)}, now)
+	}
+
+	return claims, nil
+}
+
+// cache records the result of tokenString. The expired results are pruned whenever the cache
+// doubles in size, keeping the cost of a cache miss constant on average.
+func (in *introspector) cache(tokenString string, result introspectionResult, now time.Time) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	if len(in.results) >= in.pruneAt {
+		for cached, result := range in.results {
+			if !now.Before(result.expire) {
+				delete(in.results, cached)
+			}
+		}
+		in.pruneAt = 2 * len(in.results)
+		if in.pruneAt < minPruneSize {
+			in.pruneAt = minPruneSize
+		}
+	}
+
+	in.results[tokenString] = result
+}
+
+// copyClaims keeps the cached claims safe from the handlers modifying their payload.
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(claims))
+	for key, value := range claims {
+		copied[key] = value
+	}
+	return copied
+}
+
+func (in *introspector) request(tokenString string) (map[string]interface{}, error) {
+	form := url.Values{"token": {tokenString}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest("POST", in.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if in.clientID != "" {
+		request.SetBasicAuth(in.clientID, in.clientSecret)
+	}
+
+	response, err := in.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection request failed with status %d", response.StatusCode)
+	}
+
+	claims := map[string]interface{}{}
+	if err := json.NewDecoder(response.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
@@ -0,0 +1,238 @@
+package jwt
+
+import (
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuthJWTIntrospection(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	now := time.Unix(1000000, 0)
+	expire := now.Add(time.Minute)
+
+	var mutex sync.Mutex
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+
+		if r.Method != "POST" || r.FormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if clientID, clientSecret, ok := r.BasicAuth(); !ok || clientID != "api" || clientSecret != "api secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		response := map[string]interface{}{"active": false}
+		switch r.FormValue("token") {
+		case "opaque-admin":
+			response = map[string]interface{}{"active": true, "sub": "admin", "scope": "read", "exp": expire.Unix()}
+		case "opaque-no-exp":
+			response = map[string]interface{}{"active": true, "sub": "user"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	authMiddleware := &JWTMiddleware{
+		Realm:                     "test zone",
+		Key:                       key,
+		IntrospectionURL:          server.URL,
+		IntrospectionClientID:     "api",
+		IntrospectionClientSecret: "api secret",
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		payload := r.Env["JWT_PAYLOAD"].(map[string]interface{})
+		w.WriteJson(map[string]interface{}{"Id": r.Env["REMOTE_USER"], "Scope": payload["scope"]})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+	introspections := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests
+	}
+
+	// active opaque token, cached until its exp
+	recorded := request("opaque-admin")
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"admin","Scope":"read"}`)
+	request("opaque-admin").CodeIs(200)
+	if introspections() != 1 {
+		t.Errorf("expected the result to be cached, got %d introspections", introspections())
+	}
+
+	now = now.Add(time.Minute)
+	request("opaque-admin").CodeIs(401)
+	if introspections() != 2 {
+		t.Errorf("expected the token to be introspected again, got %d introspections", introspections())
+	}
+
+	// tokens without exp aren't cached
+	request("opaque-no-exp").CodeIs(200)
+	request("opaque-no-exp").CodeIs(200)
+	if introspections() != 4 {
+		t.Errorf("expected no caching without exp, got %d introspections", introspections())
+	}
+
+	// inactive opaque token
+	request("opaque-revoked").CodeIs(401)
+
+	// JWTs are still verified locally
+	mutex.Lock()
+	requests = 0
+	mutex.Unlock()
+	request(makeTokenString("admin", key)).CodeIs(200)
+	request(makeTokenString("admin", []byte("sekret key sekret key sekret key"))).CodeIs(401)
+	if introspections() != 0 {
+		t.Errorf("expected JWTs not to be introspected, got %d introspections", introspections())
+	}
+}
+
+func TestAuthJWTIntrospectionRegisteredClaims(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{"active": true, "sub": "admin", "iss": "https://issuer.example.com", "aud": "api", "jti": r.FormValue("token"), "iat": 1000000}
+		switch r.FormValue("token") {
+		case "opaque-other-audience":
+			response["aud"] = "other"
+		case "opaque-other-issuer":
+			response["iss"] = "https://evil.example.com"
+		case "opaque-old":
+			response["iat"] = 900000
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	revocations := &MemoryRevocationStore{}
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		Key:              []byte("secret key secret key secret key"),
+		IntrospectionURL: server.URL,
+		Issuer:           "https://issuer.example.com",
+		Audience:         "api",
+		RevocationStore:  revocations,
+		NotBefore:        time.Unix(950000, 0),
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]interface{}{"Id": r.Env["REMOTE_USER"]})
+	}))
+	handler := api.MakeHandler()
+
+	var reason error
+	authMiddleware.Unauthorized = func(writer rest.ResponseWriter, request *rest.Request, err error) {
+		reason = err
+		writer.WriteHeader(http.StatusUnauthorized)
+	}
+
+	request := func(tokenString string) *test.Recorded {
+		reason = nil
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	request("opaque-admin").CodeIs(200)
+
+	cases := []struct {
+		token  string
+		reason error
+	}{
+		{"opaque-other-audience", ErrInvalidAudience},
+		{"opaque-other-issuer", ErrInvalidIssuer},
+		{"opaque-old", ErrRevokedToken},
+	}
+	for _, c := range cases {
+		request(c.token).CodeIs(401)
+		if reason != c.reason {
+			t.Errorf("%s: expected %v, got %v", c.token, c.reason, reason)
+		}
+	}
+
+	revocations.Revoke("opaque-revoked", time.Now().Add(time.Hour))
+	request("opaque-revoked").CodeIs(401)
+	if reason != ErrRevokedToken {
+		t.Errorf("expected %v, got %v", ErrRevokedToken, reason)
+	}
+}
+
+func TestIntrospectionCachePruning(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	in := newIntrospector("http://localhost/", "", "", "id", stdLogger{})
+
+	for i := 0; i < 10000; i++ {
+		in.cache(strconv.Itoa(i), introspectionResult{map[string]interface{}{}, now.Add(time.Second)}, now)
+		now = now.Add(time.Second)
+	}
+
+	if len(in.results) > 2*minPruneSize {
+		t.Errorf("Expected the expired results to be pruned, %d are kept", len(in.results))
+	}
+	if _, ok := in.results["9999"]; !ok {
+		t.Error("Expected the last result to be kept")
+	}
+}
+
+func TestAuthJWTIntrospectionUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		Key:              []byte("secret key secret key secret key"),
+		IntrospectionURL: server.URL,
+		Logger:           logger,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer opaque-admin")
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(401)
+
+	if len(logger.lines) != 1 {
+		t.Errorf("expected the introspection failure to be logged, got %v", logger.lines)
+	}
+}
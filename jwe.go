@@ -0,0 +1,119 @@
+package jwt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Key sizes of the supported JWE content encryption algorithms, used with direct encryption.
+var jweKeySizes = map[string]int{
+	"A128GCM": 16,
+	"A192GCM": 24,
+	"A256GCM": 32,
+}
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+}
+
+// encryptToken wraps the signed token into a JWE in compact serialization, directly encrypted
+// with EncryptionKey. Tokens are returned as is when encryption is disabled.
+func (mw *JWTMiddleware) encryptToken(tokenString string) (string, error) {
+	if mw.EncryptionKey == nil {
+		return tokenString, nil
+	}
+
+	header, err := json.Marshal(jweHeader{Alg: "dir", Enc: mw.EncryptionAlgorithm, Cty: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+
+	gcm, err := newGCM(mw.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	// the header is authenticated as additional data, the tag is appended to the ciphertext
+	sealed := gcm.Seal(nil, iv, []byte(tokenString), []byte(encodedHeader))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		encodedHeader,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptToken returns the signed token carried by a JWE issued by encryptToken. Tokens are
+// returned as is when encryption is disabled.
+func (mw *JWTMiddleware) decryptToken(tokenString string) (string, error) {
+	if mw.EncryptionKey == nil {
+		return tokenString, nil
+	}
+
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return "", errors.New("Token isn't a directly encrypted JWE")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	var header jweHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "dir" || header.Enc != mw.EncryptionAlgorithm {
+		return "", errors.New("Unexpected JWE algorithm")
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(mw.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return "", errors.New("Invalid JWE")
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
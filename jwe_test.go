@@ -0,0 +1,82 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strings"
+	"testing"
+)
+
+func TestJWE(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+
+	authMiddleware := &JWTMiddleware{
+		Realm:         "test zone",
+		Key:           key,
+		EncryptionKey: []byte("encryption key encryption key 32"),
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"email": "admin@example.com"}
+		},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]interface{}{"Email": r.Env["JWT_PAYLOAD"].(map[string]interface{})["email"]})
+	}))
+	handler := api.MakeHandler()
+
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 5 {
+		t.Fatalf("Expected a JWE in compact serialization, got %s", tokenString)
+	}
+
+	recorded := request(tokenString)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Email":"admin@example.com"}`)
+
+	// signed but not encrypted
+	request(makeTokenString("admin", key)).CodeIs(401)
+
+	// tampered ciphertext
+	tampered := []byte(parts[3])
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+	parts[3] = string(tampered)
+	request(strings.Join(parts, ".")).CodeIs(401)
+
+	// encrypted with another key
+	other := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 key,
+		EncryptionKey:       []byte("another encryption key of 32 b.."),
+		EncryptionAlgorithm: "A256GCM",
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	other.MiddlewareFunc(nil)
+	otherString, _, err := other.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(otherString).CodeIs(401)
+}
@@ -0,0 +1,216 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Minimum time between two fetches of the JWKS document triggered by an unknown kid, so that
+// tokens with random key ids can't be used to flood the identity provider.
+const jwksMinRefetchInterval = 10 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jwksCache fetches the public keys of a JWKS document and caches them by kid. The document is
+// fetched outside of the lock, at most once at a time, so that cached kids are served while the
+// identity provider is slow to answer.
+type jwksCache struct {
+	url             string
+	refreshInterval time.Duration
+	client          *http.Client
+	logger          Logger
+
+	mutex     sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	// fetch in flight, nil when there is none
+	inFlight *jwksFetch
+}
+
+// jwksFetch is a fetch of the JWKS document, done is closed once err is set.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newJWKSCache(url string, refreshInterval time.Duration, logger Logger) *jwksCache {
+	return &jwksCache{
+		url:             url,
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		logger:          logger,
+	}
+}
+
+// key returns the public key with the given kid. The document is fetched again when the cache
+// is older than the refresh interval, or once when the kid is unknown. Only the callers that
+// need the fetched keys wait for it.
+func (cache *jwksCache) key(kid string) (interface{}, error) {
+	keys, fetchedAt := cache.cached()
+	key, ok := keys[kid]
+
+	if keys == nil || time.Since(fetchedAt) > cache.refreshInterval {
+		// keep serving the cached keys while fetching, and if the identity provider is unavailable
+		err := cache.refresh(!ok)
+		if !ok {
+			if err != nil && keys == nil {
+				return nil, err
+			}
+			keys, fetchedAt = cache.cached()
+			key, ok = keys[kid]
+		}
+	}
+
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(fetchedAt) > jwksMinRefetchInterval {
+		if err := cache.refresh(true); err != nil {
+			return nil, err
+		}
+		keys, _ = cache.cached()
+		if key, ok := keys[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, ErrUnknownKID
+}
+
+// cached returns the cached keys and the time they were fetched.
+func (cache *jwksCache) cached() (map[string]interface{}, time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.keys, cache.fetchedAt
+}
+
+// refresh starts fetching the document, unless a fetch is already in flight, and waits for its
+// result when wait is set.
+func (cache *jwksCache) refresh(wait bool) error {
+	cache.mutex.Lock()
+	fetch := cache.inFlight
+	if fetch == nil {
+		fetch = &jwksFetch{done: make(chan struct{})}
+		cache.inFlight = fetch
+		go cache.fetch(fetch)
+	}
+	cache.mutex.Unlock()
+
+	if !wait {
+		return nil
+	}
+	<-fetch.done
+	return fetch.err
+}
+
+func (cache *jwksCache) fetch(fetch *jwksFetch) {
+	keys, err := cache.download()
+	if err != nil {
+		cache.logger.Printf("jwt: can't fetch JWKS from %s: %v", cache.url, err)
+	}
+
+	cache.mutex.Lock()
+	if err == nil {
+		cache.keys = keys
+		cache.fetchedAt = time.Now()
+	}
+	cache.inFlight = nil
+	cache.mutex.Unlock()
+
+	fetch.err = err
+	close(fetch.done)
+}
+
+func (cache *jwksCache) download() (map[string]interface{}, error) {
+	response, err := cache.client.Get(cache.url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request failed with status %d", response.StatusCode)
+	}
+
+	set := jsonWebKeySet{}
+	if err := json.NewDecoder(response.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		// skip the keys of unsupported types instead of failing the whole set
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("Unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("Unsupported key type " + jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
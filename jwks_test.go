@@ -0,0 +1,204 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"n":   encodeBigInt(key.N),
+		"e":   encodeBigInt(big.NewInt(int64(key.E))),
+	}
+}
+
+func makeKIDTokenString(alg string, kid string, key interface{}) string {
+	token := jwt.New(jwt.GetSigningMethod(alg))
+	token.Header["kid"] = kid
+	token.Claims["id"] = "admin"
+	token.Claims["exp"] = time.Now().Add(time.Hour).Unix()
+	tokenString, _ := token.SignedString(key)
+	return tokenString
+}
+
+func TestAuthJWTJWKS(t *testing.T) {
+	firstKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	fetches := 0
+	keys := []map[string]string{rsaJWK("first", &firstKey.PublicKey)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	authMiddleware := &JWTMiddleware{
+		Realm:            "test zone",
+		SigningAlgorithm: "RS256",
+		JWKSURL:          server.URL,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	get := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	get(makeKIDTokenString("RS256", "first", firstKey)).CodeIs(200)
+	get(makeKIDTokenString("RS256", "first", firstKey)).CodeIs(200)
+	if fetches != 1 {
+		t.Errorf("JWKS is expected to be fetched once, got %d", fetches)
+	}
+
+	// signed with a key not matching its kid
+	get(makeKIDTokenString("RS256", "first", secondKey)).CodeIs(401)
+
+	// the identity provider publishes a new key, which is fetched on the first miss
+	mutex.Lock()
+	keys = append(keys, rsaJWK("second", &secondKey.PublicKey))
+	mutex.Unlock()
+	authMiddleware.jwks.fetchedAt = time.Now().Add(-time.Minute)
+
+	get(makeKIDTokenString("RS256", "second", secondKey)).CodeIs(200)
+	if fetches != 2 {
+		t.Errorf("JWKS is expected to be fetched again on unknown kid, got %d", fetches)
+	}
+
+	// unknown kids don't refetch the document again right away
+	get(makeKIDTokenString("RS256", "third", secondKey)).CodeIs(401)
+	if fetches != 2 {
+		t.Errorf("JWKS is expected not to be refetched right away, got %d", fetches)
+	}
+}
+
+func TestAuthJWTJWKSCachedKIDDoesntWaitForFetch(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	fetches := 0
+	refetched := make(chan struct{})
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetches++
+		fetch := fetches
+		mutex.Unlock()
+		if fetch > 1 {
+			// the identity provider hangs on the refresh
+			close(refetched)
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("first", &privKey.PublicKey)}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cache := newJWKSCache(server.URL, time.Hour, stdLogger{})
+	if _, err := cache.key("first"); err != nil {
+		t.Fatalf("expected the key, got %v", err)
+	}
+
+	cache.mutex.Lock()
+	cache.fetchedAt = time.Now().Add(-2 * time.Hour)
+	cache.mutex.Unlock()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := cache.key("first"); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the cached key, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cached kid is expected not to wait for the fetch in flight")
+	}
+
+	<-refetched
+	mutex.Lock()
+	defer mutex.Unlock()
+	if fetches != 2 {
+		t.Errorf("JWKS is expected to be refetched once while in flight, got %d", fetches)
+	}
+}
+
+func TestJSONWebKeyEC(t *testing.T) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk := jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   encodeBigInt(privKey.X),
+		Y:   encodeBigInt(privKey.Y),
+	}
+
+	key, err := jwk.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok || pubKey.X.Cmp(privKey.X) != 0 || pubKey.Y.Cmp(privKey.Y) != 0 {
+		t.Error("EC key is expected to match the encoded key")
+	}
+
+	jwk.Crv = "P-192"
+	if _, err := jwk.publicKey(); err == nil {
+		t.Error("Unsupported curve is expected to fail")
+	}
+}
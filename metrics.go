@@ -0,0 +1,39 @@
+package jwt
+
+import (
+	"time"
+)
+
+// Metrics receives the events of the middleware, e.g. to export them as Prometheus counters and
+// histograms. Failure reasons are the messages of the errors returned by the middleware, such as
+// ErrExpiredToken. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncLoginSuccess is called when LoginHandler issues a token.
+	IncLoginSuccess()
+
+	// IncLoginFailure is called when LoginHandler rejects a login.
+	IncLoginFailure(reason string)
+
+	// IncAuthSuccess is called when the middleware accepts a request.
+	IncAuthSuccess()
+
+	// IncAuthFailure is called when the middleware rejects a request.
+	IncAuthFailure(reason string)
+
+	// IncRefresh is called when RefreshHandler or RefreshTokenHandler issues a token.
+	IncRefresh()
+
+	// ObserveValidationDuration is called with the time spent extracting and validating the token
+	// of a request.
+	ObserveValidationDuration(d time.Duration)
+}
+
+// noopMetrics is the default Metrics, discarding all events.
+type noopMetrics struct{}
+
+func (noopMetrics) IncLoginSuccess()                          {}
+func (noopMetrics) IncLoginFailure(reason string)             {}
+func (noopMetrics) IncAuthSuccess()                           {}
+func (noopMetrics) IncAuthFailure(reason string)              {}
+func (noopMetrics) IncRefresh()                               {}
+func (noopMetrics) ObserveValidationDuration(d time.Duration) {}
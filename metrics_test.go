@@ -0,0 +1,103 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMetrics struct {
+	mutex       sync.Mutex
+	events      map[string]int
+	validations int
+}
+
+func (m *recordingMetrics) inc(event string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.events == nil {
+		m.events = map[string]int{}
+	}
+	m.events[event]++
+}
+
+func (m *recordingMetrics) IncLoginSuccess()              { m.inc("login success") }
+func (m *recordingMetrics) IncLoginFailure(reason string) { m.inc("login failure: " + reason) }
+func (m *recordingMetrics) IncAuthSuccess()               { m.inc("auth success") }
+func (m *recordingMetrics) IncAuthFailure(reason string)  { m.inc("auth failure: " + reason) }
+func (m *recordingMetrics) IncRefresh()                   { m.inc("refresh") }
+
+func (m *recordingMetrics) ObserveValidationDuration(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.validations++
+}
+
+func TestMetrics(t *testing.T) {
+	key := []byte("secret key secret key secret key")
+	metrics := &recordingMetrics{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        key,
+		MaxRefresh: time.Hour * 24,
+		Metrics:    metrics,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	wrongCreds := map[string]string{"username": "admin", "password": "wrong"}
+	test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", wrongCreds)).CodeIs(401)
+
+	loginCreds := map[string]string{"username": "admin", "password": "admin"}
+	test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", loginCreds)).CodeIs(200)
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil)).CodeIs(401)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	test.RunRequest(t, handler, req).CodeIs(200)
+
+	refreshReq := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+	refreshReq.Header.Set("Authorization", "Bearer "+makeTokenString("admin", key))
+	test.RunRequest(t, handler, refreshReq).CodeIs(200)
+
+	expected := map[string]int{
+		"login failure: " + ErrFailedAuthentication.Error(): 1,
+		"login success": 1,
+		"auth failure: " + ErrNoAuthHeader.Error(): 1,
+		"auth success": 2,
+		"refresh":      1,
+	}
+	for event, count := range expected {
+		if metrics.events[event] != count {
+			t.Errorf("Expected %d %s events, got %d", count, event, metrics.events[event])
+		}
+	}
+	if len(metrics.events) != len(expected) {
+		t.Errorf("Expected events %v, got %v", expected, metrics.events)
+	}
+	if metrics.validations != 3 {
+		t.Errorf("Expected 3 validations, got %d", metrics.validations)
+	}
+}
@@ -0,0 +1,133 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginRateLimiter throttles the login attempts, e.g. to slow down credential stuffing.
+// Implementations must be safe for concurrent use. Those that also have a
+// RetryAfter(userId string, ip string) time.Duration method, like MemoryLoginRateLimiter, tell
+// the throttled clients when to retry in a Retry-After header.
+type LoginRateLimiter interface {
+	// Allow reports whether a login attempt for userId from the client ip may be made. The userId
+	// is empty when LoginPayloadFunc is used, as it's only known once the login is verified.
+	Allow(userId string, ip string) bool
+}
+
+// MemoryLoginRateLimiter is an in-memory LoginRateLimiter, only suitable for a single server.
+// It's a token bucket per username and client ip, allowing Burst attempts at once, then one
+// attempt every Interval.
+// The zero value is ready to use.
+type MemoryLoginRateLimiter struct {
+	// Number of attempts that can be made at once. Optional, defaults to 5.
+	Burst int
+
+	// Time to regain one attempt. Optional, defaults to one minute.
+	Interval time.Duration
+
+	// Function that provides the current time. Optional, defaults to time.Now.
+	TimeFunc func() time.Time
+
+	mutex   sync.Mutex
+	buckets map[string]*loginBucket
+	// size of buckets triggering the next pruning
+	pruneAt int
+}
+
+// retryAfterer is implemented by the LoginRateLimiters knowing when denied attempts can be retried.
+type retryAfterer interface {
+	RetryAfter(userId string, ip string) time.Duration
+}
+
+type loginBucket struct {
+	attempts float64
+	last     time.Time
+}
+
+func (limiter *MemoryLoginRateLimiter) burst() float64 {
+	if limiter.Burst == 0 {
+		return 5
+	}
+	return float64(limiter.Burst)
+}
+
+func (limiter *MemoryLoginRateLimiter) interval() time.Duration {
+	if limiter.Interval == 0 {
+		return time.Minute
+	}
+	return limiter.Interval
+}
+
+func (limiter *MemoryLoginRateLimiter) now() time.Time {
+	if limiter.TimeFunc == nil {
+		return time.Now()
+	}
+	return limiter.TimeFunc()
+}
+
+// refill adds the attempts regained by bucket since it was last used, reporting whether it's
+// full, and so behaves like a missing one.
+func (limiter *MemoryLoginRateLimiter) refill(bucket *loginBucket, now time.Time) bool {
+	bucket.attempts += float64(now.Sub(bucket.last)) / float64(limiter.interval())
+	bucket.last = now
+	if bucket.attempts >= limiter.burst() {
+		bucket.attempts = limiter.burst()
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns the time after which the bucket of userId and ip regains an attempt.
+func (limiter *MemoryLoginRateLimiter) RetryAfter(userId string, ip string) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	bucket, ok := limiter.buckets[userId+"\x00"+ip]
+	if !ok || limiter.refill(bucket, limiter.now()) || bucket.attempts >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.attempts) * float64(limiter.interval()))
+}
+
+// Allow consumes an attempt of the bucket of userId and ip, returning false if it's empty. The
+// full buckets are pruned whenever their number doubles, keeping the cost of an attempt constant
+// on average.
+func (limiter *MemoryLoginRateLimiter) Allow(userId string, ip string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+
+	if limiter.buckets == nil {
+		limiter.buckets = map[string]*loginBucket{}
+	}
+
+	if len(limiter.buckets) >= limiter.pruneAt {
+		for key, bucket := range limiter.buckets {
+			if limiter.refill(bucket, now) {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.pruneAt = 2 * len(limiter.buckets)
+		if limiter.pruneAt < minPruneSize {
+			limiter.pruneAt = minPruneSize
+		}
+	}
+
+	key := userId + "\x00" + ip
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &loginBucket{attempts: limiter.burst(), last: now}
+		limiter.buckets[key] = bucket
+	} else {
+		limiter.refill(bucket, now)
+	}
+
+	if bucket.attempts < 1 {
+		return false
+	}
+
+	bucket.attempts--
+	return true
+}
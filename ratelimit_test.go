@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryLoginRateLimiter(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	limiter := &MemoryLoginRateLimiter{
+		Burst:    2,
+		Interval: time.Minute,
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	if !limiter.Allow("admin", "10.0.0.1") || !limiter.Allow("admin", "10.0.0.1") {
+		t.Error("Attempts within the burst are expected to be allowed")
+	}
+	if limiter.Allow("admin", "10.0.0.1") {
+		t.Error("Attempts beyond the burst are expected to be denied")
+	}
+
+	if !limiter.Allow("admin", "10.0.0.2") || !limiter.Allow("other", "10.0.0.1") {
+		t.Error("Buckets are expected to be per username and ip")
+	}
+
+	if retryAfter := limiter.RetryAfter("admin", "10.0.0.1"); retryAfter != time.Minute {
+		t.Errorf("Expected to retry after a minute, got %v", retryAfter)
+	}
+	now = now.Add(20 * time.Second)
+	if retryAfter := limiter.RetryAfter("admin", "10.0.0.1"); retryAfter != 40*time.Second {
+		t.Errorf("Expected to retry after the bucket refills, got %v", retryAfter)
+	}
+
+	now = now.Add(40 * time.Second)
+	if !limiter.Allow("admin", "10.0.0.1") {
+		t.Error("An attempt is expected to be regained after Interval")
+	}
+	if limiter.Allow("admin", "10.0.0.1") {
+		t.Error("Only one attempt is expected to be regained after Interval")
+	}
+
+}
+
+func TestMemoryLoginRateLimiterPruning(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	limiter := &MemoryLoginRateLimiter{
+		Burst:    2,
+		Interval: time.Second,
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	for i := 0; i < 10000; i++ {
+		limiter.Allow(strconv.Itoa(i), "10.0.0.1")
+		now = now.Add(time.Second)
+	}
+
+	if len(limiter.buckets) > 2*minPruneSize {
+		t.Errorf("Full buckets are expected to be pruned, %d are kept", len(limiter.buckets))
+	}
+}
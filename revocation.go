@@ -0,0 +1,88 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps track of revoked tokens, identified by their jti claim. Implementations
+// must be safe for concurrent use. To share revocations between several servers, implement it on
+// top of a shared database, e.g. in Redis by storing the jti as a key that expires together with
+// the token and checking for its existence in IsRevoked.
+type RevocationStore interface {
+	// IsRevoked reports whether the token with the given jti was revoked.
+	IsRevoked(jti string) bool
+}
+
+// RefreshTokenStore keeps track of consumed refresh tokens, identified by their jti claim.
+// Implementations must be safe for concurrent use.
+type RefreshTokenStore interface {
+	// Consume marks the refresh token with the given jti, valid until expire, as used. It must
+	// return false if the token was already consumed, atomically with marking it.
+	Consume(jti string, expire time.Time) bool
+}
+
+// MemoryRevocationStore is an in-memory RevocationStore and RefreshTokenStore, only suitable
+// for a single server. Consumed refresh tokens are revoked.
+// The zero value is ready to use.
+type MemoryRevocationStore struct {
+	mutex   sync.RWMutex
+	revoked map[string]time.Time
+	// size of revoked triggering the next pruning
+	pruneAt int
+}
+
+// Revoke revokes the token with the given jti. The revocation is kept until expire, which should
+// be the expiry time of the token, after which the token is rejected anyway.
+func (store *MemoryRevocationStore) Revoke(jti string, expire time.Time) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.revoke(jti, expire)
+}
+
+// Consume revokes the refresh token with the given jti, returning false if it was already revoked.
+func (store *MemoryRevocationStore) Consume(jti string, expire time.Time) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if revokedUntil, ok := store.revoked[jti]; ok && !revokedUntil.Before(time.Now()) {
+		return false
+	}
+
+	store.revoke(jti, expire)
+	return true
+}
+
+// revoke records the revocation of jti. The expired revocations are pruned whenever the store
+// doubles in size, keeping the cost of revoking constant on average.
+func (store *MemoryRevocationStore) revoke(jti string, expire time.Time) {
+	if store.revoked == nil {
+		store.revoked = map[string]time.Time{}
+	}
+
+	if len(store.revoked) >= store.pruneAt {
+		now := time.Now()
+		for revokedJTI, revokedUntil := range store.revoked {
+			if revokedUntil.Before(now) {
+				delete(store.revoked, revokedJTI)
+			}
+		}
+		store.pruneAt = 2 * len(store.revoked)
+		if store.pruneAt < minPruneSize {
+			store.pruneAt = minPruneSize
+		}
+	}
+
+	store.revoked[jti] = expire
+}
+
+// IsRevoked reports whether the token with the given jti was revoked, and the revocation hasn't
+// expired.
+func (store *MemoryRevocationStore) IsRevoked(jti string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	revokedUntil, ok := store.revoked[jti]
+	return ok && !revokedUntil.Before(time.Now())
+}
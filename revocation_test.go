@@ -0,0 +1,60 @@
+package jwt
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryRevocationStore(t *testing.T) {
+	store := &MemoryRevocationStore{}
+
+	if store.IsRevoked("a") {
+		t.Error("Empty store is expected to revoke nothing")
+	}
+
+	store.Revoke("a", time.Now().Add(time.Hour))
+	store.Revoke("b", time.Now().Add(-time.Hour))
+
+	if !store.IsRevoked("a") {
+		t.Error("Token a is expected to be revoked")
+	}
+	if store.IsRevoked("c") {
+		t.Error("Token c is expected not to be revoked")
+	}
+
+	// expired revocations are ignored
+	if store.IsRevoked("b") {
+		t.Error("Expired revocation of token b is expected to be ignored")
+	}
+}
+
+func TestMemoryRevocationStorePruning(t *testing.T) {
+	store := &MemoryRevocationStore{}
+
+	for i := 0; i < 10000; i++ {
+		store.Revoke(strconv.Itoa(i), time.Now().Add(-time.Hour))
+	}
+	store.Revoke("last", time.Now().Add(time.Hour))
+
+	if len(store.revoked) > 2*minPruneSize {
+		t.Errorf("Expected the expired revocations to be pruned, %d are kept", len(store.revoked))
+	}
+	if !store.IsRevoked("last") {
+		t.Error("Expected the last revocation to be kept")
+	}
+}
+
+func TestMemoryRevocationStoreConsume(t *testing.T) {
+	store := &MemoryRevocationStore{}
+
+	if !store.Consume("a", time.Now().Add(time.Hour)) {
+		t.Error("First use of token a is expected to succeed")
+	}
+	if store.Consume("a", time.Now().Add(time.Hour)) {
+		t.Error("Second use of token a is expected to fail")
+	}
+	if !store.IsRevoked("a") {
+		t.Error("Consumed token a is expected to be revoked")
+	}
+}
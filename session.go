@@ -0,0 +1,97 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionStore keeps track of the sessions started by a login, identified by the sid claim of
+// their tokens, so that they can be revoked centrally before the end of their refresh window.
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Create records the new session sid of userId, which can be refreshed until expire.
+	Create(sid string, userId string, expire time.Time) error
+
+	// IsActive reports whether the session sid exists and was neither revoked nor has expired.
+	IsActive(sid string) bool
+}
+
+// MemorySessionStore is an in-memory SessionStore, only suitable for a single server.
+// The zero value is ready to use.
+type MemorySessionStore struct {
+	// Function that provides the current time. Optional, defaults to time.Now.
+	TimeFunc func() time.Time
+
+	mutex    sync.RWMutex
+	sessions map[string]memorySession
+	// size of sessions triggering the next pruning
+	pruneAt int
+}
+
+type memorySession struct {
+	userId string
+	expire time.Time
+}
+
+func (store *MemorySessionStore) now() time.Time {
+	if store.TimeFunc == nil {
+		return time.Now()
+	}
+	return store.TimeFunc()
+}
+
+// Create records the new session sid of userId. The expired sessions are pruned whenever the
+// store doubles in size, keeping the cost of a login constant on average.
+func (store *MemorySessionStore) Create(sid string, userId string, expire time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.sessions == nil {
+		store.sessions = map[string]memorySession{}
+	}
+
+	if len(store.sessions) >= store.pruneAt {
+		now := store.now()
+		for activeSID, session := range store.sessions {
+			if session.expire.Before(now) {
+				delete(store.sessions, activeSID)
+			}
+		}
+		store.pruneAt = 2 * len(store.sessions)
+		if store.pruneAt < minPruneSize {
+			store.pruneAt = minPruneSize
+		}
+	}
+
+	store.sessions[sid] = memorySession{userId, expire}
+	return nil
+}
+
+// IsActive reports whether the session sid exists and hasn't expired.
+func (store *MemorySessionStore) IsActive(sid string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	session, ok := store.sessions[sid]
+	return ok && !session.expire.Before(store.now())
+}
+
+// Revoke ends the session sid, its tokens can't be refreshed anymore.
+func (store *MemorySessionStore) Revoke(sid string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.sessions, sid)
+}
+
+// RevokeUser ends all the sessions of userId.
+func (store *MemorySessionStore) RevokeUser(userId string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for sid, session := range store.sessions {
+		if session.userId == userId {
+			delete(store.sessions, sid)
+		}
+	}
+}
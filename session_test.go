@@ -0,0 +1,259 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := &MemorySessionStore{
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	if store.IsActive("a") {
+		t.Error("Empty store is expected to have no active session")
+	}
+
+	store.Create("a", "admin", now.Add(time.Hour))
+	store.Create("b", "admin", now.Add(2*time.Hour))
+	store.Create("c", "user", now.Add(2*time.Hour))
+
+	if !store.IsActive("a") || !store.IsActive("b") || !store.IsActive("c") {
+		t.Error("Sessions a, b and c are expected to be active")
+	}
+
+	store.Revoke("c")
+	if store.IsActive("c") {
+		t.Error("Revoked session c is expected not to be active")
+	}
+
+	now = now.Add(90 * time.Minute)
+	if store.IsActive("a") {
+		t.Error("Expired session a is expected not to be active")
+	}
+
+	store.RevokeUser("admin")
+	if store.IsActive("b") {
+		t.Error("Session b of the revoked user is expected not to be active")
+	}
+}
+
+func TestMemorySessionStorePruning(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := &MemorySessionStore{
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	for i := 0; i < 10000; i++ {
+		store.Create(strconv.Itoa(i), "admin", now.Add(time.Second))
+		now = now.Add(time.Second)
+	}
+
+	if len(store.sessions) > 2*minPruneSize {
+		t.Errorf("Expected the expired sessions to be pruned, %d are kept", len(store.sessions))
+	}
+	if !store.IsActive("9999") {
+		t.Error("Expected the last session to be kept")
+	}
+}
+
+func TestAuthJWTSessionStore(t *testing.T) {
+	issuedAt := time.Unix(1000000, 0)
+	now := issuedAt
+	timeFunc := func() time.Time {
+		return now
+	}
+	store := &MemorySessionStore{TimeFunc: timeFunc}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:        "test zone",
+		Key:          []byte("secret key secret key secret key"),
+		Timeout:      time.Hour,
+		MaxRefresh:   24 * time.Hour,
+		SessionStore: store,
+		TimeFunc:     timeFunc,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.RefreshHandler))
+	handler := api.MakeHandler()
+
+	refresh := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	firstToken, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondToken, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = issuedAt.Add(30 * time.Minute)
+	recorded := refresh(firstToken)
+	recorded.CodeIs(200)
+
+	// the refreshed token belongs to the same session
+	rToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &rToken)
+	first, _ := authMiddleware.validateToken(firstToken, false)
+	refreshed, _ := authMiddleware.validateToken(rToken.Token, false)
+	sid, _ := first.Claims["sid"].(string)
+	if sid == "" || refreshed.Claims["sid"] != sid {
+		t.Fatalf("expected the session to be kept, got %v and %v", first.Claims["sid"], refreshed.Claims["sid"])
+	}
+
+	// revoking the session in the middle of the refresh window
+	store.Revoke(sid)
+	refresh(firstToken).CodeIs(401)
+	refresh(rToken.Token).CodeIs(401)
+
+	// the other session of the user is unaffected
+	refresh(secondToken).CodeIs(200)
+
+	// tokens without session can't be refreshed
+	noSession := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        authMiddleware.Key,
+		MaxRefresh: 24 * time.Hour,
+		TimeFunc:   timeFunc,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	noSession.MiddlewareFunc(nil)
+	tokenString, _, err := noSession.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh(tokenString).CodeIs(401)
+}
+
+func TestAuthJWTSessionStoreRefreshToken(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := &MemorySessionStore{
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		Timeout:             time.Hour,
+		MaxRefresh:          24 * time.Hour,
+		RefreshTokenTimeout: 30 * 24 * time.Hour,
+		SessionStore:        store,
+		TimeFunc: func() time.Time {
+			return now
+		},
+		Authenticator: func(userId string, password string) bool {
+			return password == "secret"
+		},
+	}
+
+	api := rest.NewApi()
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+	)
+	api.SetApp(router)
+	authMiddleware.MiddlewareFunc(nil)
+	handler := api.MakeHandler()
+
+	type tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	login := func(username string) tokens {
+		recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": username, "password": "secret"}))
+		recorded.CodeIs(200)
+		result := tokens{}
+		test.DecodeJsonPayload(recorded.Recorder, &result)
+		return result
+	}
+	refresh := func(refreshToken string) *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", map[string]string{"refresh_token": refreshToken}))
+	}
+
+	admin := login("admin")
+	user := login("user")
+
+	// the minted access token stays in the session of the login
+	loginToken, err := authMiddleware.validateToken(admin.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := refresh(admin.RefreshToken)
+	recorded.CodeIs(200)
+	minted := tokens{}
+	test.DecodeJsonPayload(recorded.Recorder, &minted)
+	mintedToken, err := authMiddleware.validateToken(minted.Token, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mintedToken.Claims["sid"] != loginToken.Claims["sid"] || mintedToken.Claims["orig_iat"] != loginToken.Claims["orig_iat"] {
+		t.Errorf("expected the session claims of the login, got %v", mintedToken.Claims)
+	}
+
+	// refresh tokens outlive MaxRefresh, as long as their session is active
+	now = now.Add(7 * 24 * time.Hour)
+	refresh(admin.RefreshToken).CodeIs(200)
+
+	// revoked sessions can't mint access tokens anymore
+	store.RevokeUser("admin")
+	recorded = refresh(admin.RefreshToken)
+	recorded.CodeIs(401)
+	refresh(user.RefreshToken).CodeIs(200)
+
+	// and the refresh tokens are bounded by NotBefore like their session
+	authMiddleware.NotBefore = now
+	refresh(user.RefreshToken).CodeIs(401)
+}
+
+func TestAuthJWTSessionStoreLogout(t *testing.T) {
+	sessions := &MemorySessionStore{}
+	authMiddleware := &JWTMiddleware{
+		Realm:        "test zone",
+		Key:          []byte("secret key secret key secret key"),
+		MaxRefresh:   time.Hour,
+		SessionStore: sessions,
+		Authenticator: func(userId string, password string) bool {
+			return false
+		},
+	}
+	authMiddleware.MiddlewareFunc(nil)
+
+	tokenString, _, err := authMiddleware.GenerateToken("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := authMiddleware.validateToken(tokenString, false)
+	sid := token.Claims["sid"].(string)
+
+	api := rest.NewApi()
+	api.SetApp(rest.AppSimple(authMiddleware.LogoutHandler))
+	req := test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	test.RunRequest(t, api.MakeHandler(), req).CodeIs(200)
+
+	if sessions.IsActive(sid) {
+		t.Error("expected logout to revoke the session")
+	}
+}
@@ -0,0 +1,132 @@
+package jwt
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TokenStore keeps track of the access tokens issued by the middleware, identified by their jti
+// claim, making them stateful: tokens that aren't in the store anymore are rejected.
+// Implementations must be safe for concurrent use.
+type TokenStore interface {
+	// Save records the token with the given jti, issued to userId and usable until exp, which is
+	// the end of its refresh window for refreshable tokens. The sessions of the tokens are saved
+	// too, see JWTMiddleware.TokenStore, again whenever one of their tokens is issued.
+	Save(jti string, userId string, exp time.Time) error
+
+	// Exists reports whether the token with the given jti is recorded and exp hasn't passed.
+	Exists(jti string) bool
+
+	// Delete forgets the token with the given jti, which is then rejected.
+	Delete(jti string) error
+}
+
+// UserTokenStore is a TokenStore that can also list the tokens of a user, as needed by
+// MaxSessionsPerUser.
+type UserTokenStore interface {
+	TokenStore
+
+	// Tokens returns the jti of the unexpired tokens and sessions of userId, the first saved
+	// first. Saving a jti again keeps its position.
+	Tokens(userId string) []string
+}
+
+// MemoryTokenStore is an in-memory TokenStore, only suitable for a single server.
+// The zero value is ready to use.
+type MemoryTokenStore struct {
+	// Function that provides the current time. Optional, defaults to time.Now.
+	TimeFunc func() time.Time
+
+	mutex  sync.RWMutex
+	tokens map[string]storedToken
+	saved  uint64
+	// size of tokens triggering the next pruning
+	pruneAt int
+}
+
+// minPruneSize is the number of stored tokens below which MemoryTokenStore doesn't prune.
+const minPruneSize = 64
+
+type storedToken struct {
+	userId string
+	exp    time.Time
+	// order in which the tokens were saved
+	seq uint64
+}
+
+func (store *MemoryTokenStore) now() time.Time {
+	if store.TimeFunc == nil {
+		return time.Now()
+	}
+	return store.TimeFunc()
+}
+
+// Save records the token with the given jti, keeping its order when it's already recorded. The
+// expired tokens are pruned whenever the store doubles in size, keeping the cost of saving
+// constant on average.
+func (store *MemoryTokenStore) Save(jti string, userId string, exp time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.tokens == nil {
+		store.tokens = map[string]storedToken{}
+	}
+
+	if len(store.tokens) >= store.pruneAt {
+		now := store.now()
+		for storedJTI, token := range store.tokens {
+			if token.exp.Before(now) {
+				delete(store.tokens, storedJTI)
+			}
+		}
+		store.pruneAt = 2 * len(store.tokens)
+		if store.pruneAt < minPruneSize {
+			store.pruneAt = minPruneSize
+		}
+	}
+
+	if token, ok := store.tokens[jti]; ok {
+		store.tokens[jti] = storedToken{userId, exp, token.seq}
+		return nil
+	}
+	store.saved++
+	store.tokens[jti] = storedToken{userId, exp, store.saved}
+	return nil
+}
+
+// Exists reports whether the token with the given jti is recorded and hasn't expired.
+func (store *MemoryTokenStore) Exists(jti string) bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	token, ok := store.tokens[jti]
+	return ok && !token.exp.Before(store.now())
+}
+
+// Delete forgets the token with the given jti.
+func (store *MemoryTokenStore) Delete(jti string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.tokens, jti)
+	return nil
+}
+
+// Tokens returns the jti of the unexpired tokens and sessions of userId, the first saved first.
+func (store *MemoryTokenStore) Tokens(userId string) []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	now := store.now()
+	jtis := []string{}
+	for jti, token := range store.tokens {
+		if token.userId == userId && !token.exp.Before(now) {
+			jtis = append(jtis, jti)
+		}
+	}
+	sort.Slice(jtis, func(i, j int) bool {
+		return store.tokens[jtis[i]].seq < store.tokens[jtis[j]].seq
+	})
+	return jtis
+}
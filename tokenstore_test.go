@@ -0,0 +1,444 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := &MemoryTokenStore{
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	if store.Exists("a") {
+		t.Error("Empty store is expected to have no token")
+	}
+
+	store.Save("a", "admin", now.Add(time.Hour))
+	store.Save("b", "admin", now.Add(2*time.Hour))
+	store.Save("c", "user", now.Add(2*time.Hour))
+
+	if !store.Exists("a") || !store.Exists("b") || !store.Exists("c") {
+		t.Error("Tokens a, b and c are expected to exist")
+	}
+
+	tokens := store.Tokens("admin")
+	sort.Strings(tokens)
+	if len(tokens) != 2 || tokens[0] != "a" || tokens[1] != "b" {
+		t.Errorf("Unexpected tokens of admin: %v", tokens)
+	}
+
+	// listed the oldest first
+	store.Save("0", "admin", now.Add(time.Hour))
+	tokens = store.Tokens("admin")
+	if len(tokens) != 3 || tokens[0] != "a" || tokens[1] != "b" || tokens[2] != "0" {
+		t.Errorf("Expected the tokens of admin in saving order, got %v", tokens)
+	}
+
+	// saving a token again keeps its position
+	store.Save("a", "admin", now.Add(time.Hour))
+	tokens = store.Tokens("admin")
+	if len(tokens) != 3 || tokens[0] != "a" {
+		t.Errorf("Expected token a to stay the oldest, got %v", tokens)
+	}
+
+	store.Delete("b")
+	if store.Exists("b") {
+		t.Error("Deleted token b is expected not to exist")
+	}
+
+	now = now.Add(90 * time.Minute)
+	if store.Exists("a") {
+		t.Error("Expired token a is expected not to exist")
+	}
+	if len(store.Tokens("admin")) != 0 {
+		t.Error("Expired tokens are expected not to be listed")
+	}
+}
+
+func TestMemoryTokenStoreConcurrency(t *testing.T) {
+	store := &MemoryTokenStore{}
+	exp := time.Now().Add(time.Hour)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				jti := string(rune('a'+i)) + string(rune('a'+j%26))
+				store.Save(jti, "admin", exp)
+				store.Exists(jti)
+				store.Tokens("admin")
+				store.Delete(jti)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(store.Tokens("admin")) != 0 {
+		t.Errorf("Expected every token to be deleted, got %v", store.Tokens("admin"))
+	}
+}
+
+func TestAuthJWTTokenStore(t *testing.T) {
+	store := &MemoryTokenStore{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		MaxRefresh: time.Hour,
+		TokenStore: store,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Post("/logout", authMiddleware.LogoutHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	request := func(method string, url string, tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	// login saves the token
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	loginToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &loginToken)
+
+	if len(store.Tokens("admin")) != 2 {
+		t.Fatalf("expected the login token and its session to be saved, got %v", store.Tokens("admin"))
+	}
+	request("GET", "http://localhost/", loginToken.Token).CodeIs(200)
+
+	// refreshed tokens are saved too, replacing the refreshed one
+	recorded = request("GET", "http://localhost/refresh_token", loginToken.Token)
+	recorded.CodeIs(200)
+	refreshedToken := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshedToken)
+	request("GET", "http://localhost/", refreshedToken.Token).CodeIs(200)
+	request("GET", "http://localhost/", loginToken.Token).CodeIs(401)
+	request("GET", "http://localhost/refresh_token", loginToken.Token).CodeIs(401)
+
+	// logout deletes the presented token
+	request("POST", "http://localhost/logout", refreshedToken.Token).CodeIs(200)
+	request("GET", "http://localhost/", refreshedToken.Token).CodeIs(401)
+
+	// valid tokens unknown to the store are rejected
+	request("GET", "http://localhost/", makeTokenString("admin", authMiddleware.Key)).CodeIs(401)
+}
+
+func TestAuthJWTMaxSessionsPerUser(t *testing.T) {
+	store := &MemoryTokenStore{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:              "test zone",
+		Key:                []byte("secret key secret key secret key"),
+		TokenStore:         store,
+		MaxSessionsPerUser: 3,
+		Authenticator: func(userId string, password string) bool {
+			return password == "secret"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	login := func(username string) string {
+		recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": username, "password": "secret"}))
+		recorded.CodeIs(200)
+		token := DecoderToken{}
+		test.DecodeJsonPayload(recorded.Recorder, &token)
+		return token.Token
+	}
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	sessions := []string{login("admin"), login("admin"), login("admin")}
+	other := login("user")
+	for _, session := range sessions {
+		request(session).CodeIs(200)
+	}
+
+	// the fourth login revokes the first session only
+	fourth := login("admin")
+	request(sessions[0]).CodeIs(401)
+	request(sessions[1]).CodeIs(200)
+	request(sessions[2]).CodeIs(200)
+	request(fourth).CodeIs(200)
+	if sessions := storedSessions(store, "admin"); len(sessions) != 3 {
+		t.Errorf("expected 3 sessions of admin, got %v", sessions)
+	}
+
+	// other users aren't affected
+	request(other).CodeIs(200)
+}
+
+func storedSessions(store UserTokenStore, userId string) []string {
+	sessions := []string{}
+	for _, key := range store.Tokens(userId) {
+		if strings.HasPrefix(key, sessionKeyPrefix) {
+			sessions = append(sessions, key)
+		}
+	}
+	return sessions
+}
+
+func TestAuthJWTMaxSessionsPerUserRefresh(t *testing.T) {
+	store := &MemoryTokenStore{}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:              "test zone",
+		Key:                []byte("secret key secret key secret key"),
+		MaxRefresh:         time.Hour,
+		TokenStore:         store,
+		MaxSessionsPerUser: 3,
+		Authenticator: func(userId string, password string) bool {
+			return password == "secret"
+		},
+	}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	login := func() string {
+		recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "secret"}))
+		recorded.CodeIs(200)
+		token := DecoderToken{}
+		test.DecodeJsonPayload(recorded.Recorder, &token)
+		return token.Token
+	}
+	request := func(url string, tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	s1, s2, s3 := login(), login(), login()
+
+	// refreshing doesn't start a new session, and replaces the refreshed token
+	recorded := request("http://localhost/refresh_token", s1)
+	recorded.CodeIs(200)
+	refreshed := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+	s1b := refreshed.Token
+	request("http://localhost/", s1).CodeIs(401)
+	request("http://localhost/", s1b).CodeIs(200)
+
+	// the fourth login revokes the oldest session, whatever its latest token
+	s4 := login()
+	request("http://localhost/", s1b).CodeIs(401)
+	request("http://localhost/refresh_token", s1b).CodeIs(401)
+	request("http://localhost/", s2).CodeIs(200)
+	request("http://localhost/", s3).CodeIs(200)
+	request("http://localhost/", s4).CodeIs(200)
+	if sessions := storedSessions(store, "admin"); len(sessions) != 3 {
+		t.Errorf("expected 3 sessions of admin, got %v", sessions)
+	}
+}
+
+func TestAuthJWTMaxSessionsPerUserConfig(t *testing.T) {
+	cases := []struct {
+		name  string
+		max   int
+		store TokenStore
+		valid bool
+	}{
+		{"unlimited", 0, nil, true},
+		{"memory store", 3, &MemoryTokenStore{}, true},
+		{"no store", 3, nil, false},
+		{"negative", -1, &MemoryTokenStore{}, false},
+	}
+
+	for _, c := range cases {
+		authMiddleware := &JWTMiddleware{
+			Realm:              "test zone",
+			Key:                []byte("secret key secret key secret key"),
+			TokenStore:         c.store,
+			MaxSessionsPerUser: c.max,
+			Authenticator: func(userId string, password string) bool {
+				return false
+			},
+		}
+		if err := authMiddleware.setup(); (err == nil) != c.valid {
+			t.Errorf("%s: unexpected setup result %v", c.name, err)
+		}
+	}
+}
+
+func TestMemoryTokenStorePruning(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	store := &MemoryTokenStore{
+		TimeFunc: func() time.Time {
+			return now
+		},
+	}
+
+	for i := 0; i < 10000; i++ {
+		store.Save(strconv.Itoa(i), "admin", now.Add(time.Second))
+		now = now.Add(time.Second)
+	}
+
+	if len(store.tokens) > 2*minPruneSize {
+		t.Errorf("Expected the expired tokens to be pruned, %d are kept", len(store.tokens))
+	}
+	if !store.Exists("9999") {
+		t.Error("Expected the last token to be kept")
+	}
+}
+
+func TestAuthJWTTokenStoreRefreshExpired(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	timeFunc := func() time.Time {
+		return now
+	}
+
+	authMiddleware := &JWTMiddleware{
+		Realm:      "test zone",
+		Key:        []byte("secret key secret key secret key"),
+		Timeout:    time.Hour,
+		MaxRefresh: 24 * time.Hour,
+		TokenStore: &MemoryTokenStore{TimeFunc: timeFunc},
+		TimeFunc:   timeFunc,
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Get("/refresh_token", authMiddleware.RefreshHandler),
+	)
+	api.SetApp(router)
+	authMiddleware.MiddlewareFunc(nil)
+	handler := api.MakeHandler()
+
+	refresh := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/refresh_token", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	login := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &login)
+
+	// expired, but within the refresh window
+	now = now.Add(2 * time.Hour)
+	recorded = refresh(login.Token)
+	recorded.CodeIs(200)
+	refreshed := DecoderToken{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+
+	// the refreshed token is kept until the end of the same window
+	now = now.Add(20 * time.Hour)
+	recorded = refresh(refreshed.Token)
+	recorded.CodeIs(200)
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+
+	now = now.Add(3 * time.Hour)
+	refresh(refreshed.Token).CodeIs(401)
+}
+
+func TestAuthJWTTokenStoreLogoutRefreshToken(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		MaxRefresh:          time.Hour,
+		RefreshTokenTimeout: 24 * time.Hour,
+		TokenStore:          &MemoryTokenStore{},
+		Authenticator: func(userId string, password string) bool {
+			return userId == "admin" && password == "admin"
+		},
+	}
+
+	api := rest.NewApi()
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Post("/logout", authMiddleware.LogoutHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+	)
+	api.SetApp(router)
+	authMiddleware.MiddlewareFunc(nil)
+	handler := api.MakeHandler()
+
+	type tokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	refresh := func(refreshToken string) *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", map[string]string{"refresh_token": refreshToken}))
+	}
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	login := tokens{}
+	test.DecodeJsonPayload(recorded.Recorder, &login)
+	refresh(login.RefreshToken).CodeIs(200)
+
+	// logout ends the session, whose refresh token can't be exchanged anymore
+	req := test.MakeSimpleRequest("POST", "http://localhost/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	test.RunRequest(t, handler, req).CodeIs(200)
+
+	refresh(login.RefreshToken).CodeIs(401)
+}
@@ -0,0 +1,44 @@
+package jwt
+
+import (
+	"sync"
+)
+
+// TokenVersionStore keeps the current token version of every user, stamped in the ver claim of
+// the issued tokens. Bumping the version of a user, e.g. when they change their password,
+// invalidates all their previous tokens at once. Implementations must be safe for concurrent use.
+type TokenVersionStore interface {
+	// Version returns the current token version of userId, 0 until it's first bumped.
+	Version(userId string) (int64, error)
+
+	// Bump increments the token version of userId and returns the new one.
+	Bump(userId string) (int64, error)
+}
+
+// MemoryTokenVersionStore is an in-memory TokenVersionStore, only suitable for a single server.
+// The zero value is ready to use.
+type MemoryTokenVersionStore struct {
+	mutex    sync.RWMutex
+	versions map[string]int64
+}
+
+// Version returns the current token version of userId.
+func (store *MemoryTokenVersionStore) Version(userId string) (int64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.versions[userId], nil
+}
+
+// Bump increments the token version of userId.
+func (store *MemoryTokenVersionStore) Bump(userId string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.versions == nil {
+		store.versions = map[string]int64{}
+	}
+
+	store.versions[userId]++
+	return store.versions[userId], nil
+}
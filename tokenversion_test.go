@@ -0,0 +1,132 @@
+package jwt
+
+import (
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenVersionStore(t *testing.T) {
+	store := &MemoryTokenVersionStore{}
+
+	if version, _ := store.Version("admin"); version != 0 {
+		t.Errorf("Expected version 0 before any bump, got %d", version)
+	}
+
+	if version, _ := store.Bump("admin"); version != 1 {
+		t.Errorf("Expected version 1 after a bump, got %d", version)
+	}
+	store.Bump("admin")
+
+	if version, _ := store.Version("admin"); version != 2 {
+		t.Errorf("Expected version 2, got %d", version)
+	}
+	if version, _ := store.Version("user"); version != 0 {
+		t.Errorf("Expected the other users not to be bumped, got %d", version)
+	}
+}
+
+func TestMemoryTokenVersionStoreConcurrency(t *testing.T) {
+	store := &MemoryTokenVersionStore{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Bump("admin")
+				store.Version("admin")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if version, _ := store.Version("admin"); version != 1000 {
+		t.Errorf("Expected version 1000, got %d", version)
+	}
+}
+
+func TestAuthJWTBumpTokenVersion(t *testing.T) {
+	authMiddleware := &JWTMiddleware{
+		Realm:               "test zone",
+		Key:                 []byte("secret key secret key secret key"),
+		MaxRefresh:          time.Hour,
+		RefreshTokenTimeout: time.Hour * 24,
+		Authenticator: func(userId string, password string) bool {
+			return password == "secret"
+		},
+	}
+
+	if err := authMiddleware.BumpTokenVersion("admin"); err == nil {
+		t.Error("expected an error without TokenVersionStore")
+	}
+	authMiddleware.TokenVersionStore = &MemoryTokenVersionStore{}
+
+	api := rest.NewApi()
+	api.Use(&rest.IfMiddleware{
+		Condition: func(request *rest.Request) bool {
+			return request.URL.Path == "/"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, _ := rest.MakeRouter(
+		rest.Post("/login", authMiddleware.LoginHandler),
+		rest.Post("/refresh_token", authMiddleware.RefreshTokenHandler),
+		rest.Get("/", func(w rest.ResponseWriter, r *rest.Request) {
+			w.WriteJson(map[string]string{"Id": r.Env["REMOTE_USER"].(string)})
+		}),
+	)
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	type loginTokens struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	login := func(username string) loginTokens {
+		recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", map[string]string{"username": username, "password": "secret"}))
+		recorded.CodeIs(200)
+		tokens := loginTokens{}
+		test.DecodeJsonPayload(recorded.Recorder, &tokens)
+		return tokens
+	}
+	request := func(tokenString string) *test.Recorded {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		return test.RunRequest(t, handler, req)
+	}
+	refresh := func(refreshToken string) *test.Recorded {
+		return test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/refresh_token", map[string]string{"refresh_token": refreshToken}))
+	}
+
+	old := login("admin")
+	other := login("user")
+	request(old.Token).CodeIs(200)
+
+	// password change
+	if err := authMiddleware.BumpTokenVersion("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// previously issued tokens are rejected
+	request(old.Token).CodeIs(401)
+	refresh(old.RefreshToken).CodeIs(401)
+
+	// newly issued ones are accepted
+	current := login("admin")
+	request(current.Token).CodeIs(200)
+	recorded := refresh(current.RefreshToken)
+	recorded.CodeIs(200)
+	refreshed := loginTokens{}
+	test.DecodeJsonPayload(recorded.Recorder, &refreshed)
+	request(refreshed.Token).CodeIs(200)
+
+	// other users aren't affected
+	request(other.Token).CodeIs(200)
+
+	// unversioned tokens are rejected
+	request(makeTokenString("admin", authMiddleware.Key)).CodeIs(401)
+}